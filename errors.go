@@ -0,0 +1,18 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrSessionNotFound = errors.New("sessionNotFound")
+
+// ConflictError is returned when a session is saved over a revision other than the one it was loaded with.
+type ConflictError struct {
+	SessionId string
+	Revision  int64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("session %v was modified since revision %v", e.SessionId, e.Revision)
+}
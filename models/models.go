@@ -1,3 +1,38 @@
 package models
 
+import "time"
+
 type Versions map[string]string
+
+// TimedVersion is a version of a cached collection and the time it became active.
+type TimedVersion struct {
+	Version string
+	TimedTo time.Time
+}
+
+// Revision is the part of a stored session repos need in order to compare and swap it.
+type Revision struct {
+	Revision int64
+}
+
+// VersionFallback is what a repo does for a collection that has no version timed before the requested date.
+type VersionFallback int
+
+const (
+	FailWithoutVersion VersionFallback = iota
+	UseOldestVersion
+	SkipCollection
+)
+
+// VersionFallbackPolicy chooses the fallback of every collection, collections missing from Collections use Default.
+type VersionFallbackPolicy struct {
+	Default     VersionFallback
+	Collections map[string]VersionFallback
+}
+
+func (p VersionFallbackPolicy) For(collectionName string) VersionFallback {
+	if fallback, ok := p.Collections[collectionName]; ok {
+		return fallback
+	}
+	return p.Default
+}
@@ -2,41 +2,135 @@ package session
 
 import (
 	"context"
+	"github.com/orchestd/session/models"
 	"time"
 )
 
 type SessionResolverBuilder interface {
 	SetRepo(repo SessionRepo) SessionResolverBuilder
+	SetMaxLifetime(maxLifetime time.Duration) SessionResolverBuilder
+	SetIdleTimeout(idleTimeout time.Duration) SessionResolverBuilder
+	SetRotationGracePeriod(gracePeriod time.Duration) SessionResolverBuilder
+	SetClock(clock Clock) SessionResolverBuilder
+	SetFakeNowPolicy(policy FakeNowPolicy) SessionResolverBuilder
+	SetFakeNowAuditor(auditor FakeNowAuditor) SessionResolverBuilder
+	SetVersionFallback(fallback models.VersionFallback) SessionResolverBuilder
+	SetCollectionVersionFallback(collectionName string, fallback models.VersionFallback) SessionResolverBuilder
+	SetVersionPreviewClaim(claim string) SessionResolverBuilder
 	Build() (SessionResolver, error)
 }
 
+// Clock is the source of wall time for sessions and the resolver.
+type Clock interface {
+	Now() time.Time
+}
+
+// FakeNowPolicy decides whether the fake time of a session may be used to resolve its time and versions.
+type FakeNowPolicy interface {
+	IsFakeNowAllowed(c context.Context, curSession Session) bool
+}
+
+type FakeNowPolicyFunc func(c context.Context, curSession Session) bool
+
+func (f FakeNowPolicyFunc) IsFakeNowAllowed(c context.Context, curSession Session) bool {
+	return f(c, curSession)
+}
+
+// FakeNowAuditRecord describes a change of a session's fake time.
+type FakeNowAuditRecord struct {
+	SessionId  string
+	CustomerId string
+	// SetBy is the token data of the request that saved the change, nil when there was none
+	SetBy   map[string]interface{}
+	FakeNow time.Time
+	Cleared bool
+	Allowed bool
+	At      time.Time
+}
+
+// FakeNowAuditor is told about every saved change of a session's fake time
+// and, once per request when its session data is set to the context, about the policy making the resolver ignore it.
+type FakeNowAuditor interface {
+	FakeNowChanged(c context.Context, record FakeNowAuditRecord)
+	FakeNowIgnored(c context.Context, curSession Session)
+}
+
 type SessionResolver interface {
 	SetDataToContext(c context.Context, cSession Session) (context.Context, error)
 	GetSessionById(c context.Context, id string) (bool, Session, error)
 	GetTokenDataValueAsString(c context.Context, key string) (string, error)
+	GetNowFromContext(c context.Context) time.Time
+	GetVersionFallbacksFromContext(c context.Context) []string
 	NewSession(id string) Session
-	SaveSession(c context.Context, cSession Session) error
+	// SaveSession, PatchSession and UpdateSession detect concurrent changes only as far as the
+	// SessionRepo's CompareAndSwap and Patch are atomic, e.g. only within one process for the cache repo.
+	SaveSession(c context.Context, cSession Session) (bool, error)
+	PatchSession(c context.Context, cSession Session) (bool, error)
+	UpdateSession(c context.Context, id string, update func(Session) error) error
+	DeleteSession(c context.Context, sessionId string) error
+	RevokeSession(c context.Context) error
+	RotateSession(c context.Context, curSession Session) (string, Session, error)
 	GetCurrentSession(c context.Context) (Session, error)
+	ReloadCurrentSession(c context.Context) (Session, error)
 	FreezeCacheVersionsForSession(c context.Context, curSession Session, action string, cacheType string) error
 	UnFreezeCacheVersionsForSession(c context.Context, curSession Session, action string) error
+	FreezeCacheVersionsForCollections(c context.Context, curSession Session, collections []string) ([]string, error)
+	UnFreezeCacheVersionsForCollections(c context.Context, curSession Session, collections []string) ([]string, error)
+	FreezeCacheVersionsForScope(c context.Context, curSession Session, scope string, action string, cacheType string, ttl time.Duration) error
+	UnFreezeCacheVersionsForScope(c context.Context, curSession Session, scope string) error
+	FreezeCacheVersionsForActiveOrder(c context.Context, curSession Session, action string, cacheType string) error
+	FreezeCacheVersionsForOrder(c context.Context, curSession Session, key string, action string, cacheType string) error
+	GetVersionsStaleness(c context.Context, curSession Session) ([]VersionStaleness, error)
 	IsObsolete(c context.Context, sessionId string) (bool, error)
 }
 
+// VersionStaleness compares the version a session froze for a collection to the latest one for the session's date.
+type VersionStaleness struct {
+	CollectionName string
+	FrozenVersion  string
+	// LatestVersion is empty when the collection has no version for the date
+	LatestVersion string
+	// VersionsBehind is -1 when the frozen version or the latest one are not in the collection's history
+	VersionsBehind int
+	// LatestActiveFor is how long the latest version has been active
+	LatestActiveFor time.Duration
+}
+
 type Session interface {
 	SetCustomerDetails(id string, isNew bool)
 	SetOtpData(uuid string)
 	SetFakeNow(fakeNow time.Time)
+	SetFakeClock(offset time.Duration, speed float64)
+	ClearFakeNow()
+	SetVersionPreview(asOf time.Time, versions map[string]string)
+	ClearVersionPreview()
+	HasVersionPreview() bool
+	GetVersionPreviewAsOf() time.Time
+	GetVersionPreviewVersions() map[string]string
 	GetFixedCacheVersions() map[string]string
 	SetFixedCacheVersions(versions map[string]string)
 	GetCurrentCacheVersions() map[string]string
 	SetCurrentCacheVersions(versions map[string]string)
+	SetFreezeScope(name string, versions map[string]string, expiresAt time.Time)
+	GetFreezeScope(name string) FreezeScopeResolver
+	GetFreezeScopes() []FreezeScopeResolver
+	RemoveFreezeScope(name string) bool
+	GetEffectiveCacheVersions() map[string]string
 	GetOtpData() string
 	GetIsNoCustomer() bool
 	GetIsCustomerNew() bool
 	GetCustomerId() string
 	HasFakeNow() bool
 	GetNow() time.Time
+	GetLocalNow() time.Time
+	SetTimeZone(timeZone string) error
+	GetTimeZone() string
 	GetId() string
+	GetCreatedAt() time.Time
+	GetLastAccessAt() time.Time
+	GetExpiresAt() time.Time
+	GetRevision() int64
+	IsDirty() bool
 	SetLang(lang string)
 	GetLang() string
 	SetTermsApproval(termsApproval bool)
@@ -45,6 +139,19 @@ type Session interface {
 	GetDeviceInfo() DeviceInfoResolver
 	SetReferrer(string)
 	GetReferrer() string
+	SetOrder(key string, id, subServiceType, storeId string, timeTo time.Time, tags []string)
+	SetOrderVersions(key string, versions map[string]string)
+	GetOrder(key string) ActiveOrderResolver
+	GetOrders() map[string]ActiveOrderResolver
+	RemoveOrder(key string)
+	SwitchActiveOrder(key string) error
+	GetActiveOrderKey() string
+	SetActiveOrder(id, subServiceType, storeId string, timeTo time.Time, tags []string)
+	SetActiveOrderVersions(versions map[string]string)
+	HasActiveOrder() bool
+	GetActiveOrder() ActiveOrderResolver
+	GetActiveOrderId() string
+	ClearActiveOrder()
 }
 
 type DeviceInfoResolver interface {
@@ -57,9 +164,45 @@ type DeviceInfoResolver interface {
 	GetOSVersion() string
 }
 
+type ActiveOrderResolver interface {
+	GetId() string
+	GetSubServiceType() string
+	GetStoreId() string
+	GetTimeTo() time.Time
+	GetTags() []string
+	GetVersions() map[string]string
+}
+
+type FreezeScopeResolver interface {
+	GetName() string
+	GetVersions() map[string]string
+	GetCreatedAt() time.Time
+	GetExpiresAt() time.Time
+}
+
 type SessionRepo interface {
 	GetUserSessionByTokenToStruct(context context.Context, token string, dest interface{}) (bool, error)
 	InsertOrUpdate(ctx context.Context, id string, obj interface{}) error
+	// CompareAndSwap stores obj only if the revision currently stored under id equals revision,
+	// a missing record never matches a revision other than 0.
+	// The stored revision is read from obj's Revision field, see models.Revision.
+	// The check and the write must be one atomic step for every writer of the store; a backend without
+	// a conditional write can only make them atomic within its own process, and must say so.
+	CompareAndSwap(ctx context.Context, id string, revision int64, obj interface{}) (bool, error)
+	// Patch sets the given top level fields of the object stored under id and increments its Revision
+	// in a single atomic step, returning the new revision. It returns false when nothing is stored under id.
+	// Backends that support partial updates natively should use them.
+	// Like CompareAndSwap, a backend without a conditional write is atomic only within its own process.
+	Patch(ctx context.Context, id string, fields map[string]interface{}) (bool, int64, error)
+	// Touch sets the given top level fields like Patch but leaves the Revision as it is,
+	// for bookkeeping such as the expiry that must not make loaded copies of the object conflict.
+	Touch(ctx context.Context, id string, fields map[string]interface{}) (bool, error)
+	Delete(ctx context.Context, id string) error
 	GetCacheVersions(ctx context.Context, now time.Time, filterAction string, filterType string) (map[string]string, error)
+	// GetCacheVersionsWithFallback applies fallback to collections without a version timed before now
+	// and returns the collections that fell back, GetCacheVersions behaves like it with every collection failing.
+	GetCacheVersionsWithFallback(ctx context.Context, now time.Time, filterAction string, filterType string, fallback models.VersionFallbackPolicy) (map[string]string, []string, error)
+	// GetVersionsHistory returns the versions of every collection ordered by the time they became active.
+	GetVersionsHistory(ctx context.Context) (map[string][]models.TimedVersion, error)
 	GetCollectionsFilterActions(ctx context.Context, filterAction string) ([]string, error)
 }
@@ -2,114 +2,593 @@ package sessionmock
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/orchestd/session"
-	"github.com/orchestd/session/models"
+	"github.com/orchestd/session/sessionresolver"
+	"github.com/orchestd/session/sessionresolver/repos/mock"
+	"github.com/orchestd/tokenauth"
+	"reflect"
+	"sync"
+	"testing"
 	"time"
 )
 
-// Session
-type ActiveOrder struct {
-	SubServiceType string    `json:"subServiceType"`
-	StoreId        string    `json:"storeId"`
-	TimeTo         time.Time `json:"timeTo"`
-	Tags           []string  `json:"tags"`
+// Call is a single recorded call to the session resolver mock.
+type Call struct {
+	Method string
+	Args   []interface{}
 }
 
-type currentSessionMock struct {
-	CustomerId    string       `json:"customerId"`
-	ActiveOrderId string       `json:"activeOrderId"`
-	FakeNow       *string      `json:"fakeNow"`
-	ActiveOrder   *ActiveOrder `json:"activeOrder"`
+// SavedSession is a snapshot of a session taken right after it was saved.
+type SavedSession struct {
+	Id                   string
+	CurrentCacheVersions map[string]string
+	FixedCacheVersions   map[string]string
+	// EffectiveCacheVersions are the frozen versions of every open freeze scope, with the fixed ones on top
+	EffectiveCacheVersions map[string]string
+	Session                session.Session
 }
 
-func (c currentSessionMock) GetActiveOrder() (hasActiveOrder bool, subServiceType string, storeId string, timeTo time.Time, tags []string) {
-	if c.ActiveOrder != nil {
-		return true, c.ActiveOrder.SubServiceType, c.ActiveOrder.StoreId, c.ActiveOrder.TimeTo, c.ActiveOrder.Tags
+type collectionsRepo interface {
+	session.SessionRepo
+	SetCollection(collection mock.Collection)
+	AddVersion(collectionName string, version string, timedTo time.Time) error
+}
+
+// sessionMockWrapper is a programmable session.SessionResolver for service tests.
+// It runs the real resolver over an in memory repo, records every call,
+// returns stubbed errors per method and serves the token data set on the mock,
+// passing it on to the resolver in the context as the token middleware would.
+type sessionMockWrapper struct {
+	resolver session.SessionResolver
+	repo     collectionsRepo
+
+	mu        sync.Mutex
+	calls     []Call
+	errors    map[string]error
+	tokenData map[string]interface{}
+	saved     []SavedSession
+	deleted   []string
+}
+
+func NewSessionMockWrapper(collections ...mock.Collection) *sessionMockWrapper {
+	repo := mock.NewCacheRepoMock(collections...)
+	resolver, err := sessionresolver.Builder().SetRepo(repo).Build()
+	if err != nil {
+		panic(fmt.Sprintf("cannot build session resolver mock: %v", err))
+	}
+	return &sessionMockWrapper{
+		resolver:  resolver,
+		repo:      repo,
+		errors:    make(map[string]error),
+		tokenData: make(map[string]interface{}),
+	}
+}
+
+// Programming
+
+// SetClock rebuilds the underlying resolver over the same sessions with the given clock,
+// e.g. a sessiontest.FakeClock. It is meant to be called while setting the mock up.
+func (s *sessionMockWrapper) SetClock(clock session.Clock) *sessionMockWrapper {
+	resolver, err := sessionresolver.Builder().SetRepo(s.repo).SetClock(clock).Build()
+	if err != nil {
+		panic(fmt.Sprintf("cannot build session resolver mock: %v", err))
+	}
+	s.resolver = resolver
+	return s
+}
+
+// SetError makes every following call to method return err, a nil err clears it.
+func (s *sessionMockWrapper) SetError(method string, err error) *sessionMockWrapper {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		delete(s.errors, method)
 	} else {
-		return false, "", "", time.Time{}, nil
+		s.errors[method] = err
 	}
+	return s
+}
+
+func (s *sessionMockWrapper) SetTokenData(key string, value string) *sessionMockWrapper {
+	return s.SetTokenClaim(key, value)
+}
+
+// SetTokenClaim sets a token claim of any JSON type, e.g. the bool claims resolver policies check.
+func (s *sessionMockWrapper) SetTokenClaim(key string, value interface{}) *sessionMockWrapper {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokenData[key] = value
+	return s
+}
+
+// SetCurrentSessionId sets the session id GetCurrentSession resolves, as if it was carried in the token.
+func (s *sessionMockWrapper) SetCurrentSessionId(id string) *sessionMockWrapper {
+	return s.SetTokenData("sessionId", id)
 }
 
-func (c currentSessionMock) GetActiveOrderId() string {
-	return c.ActiveOrderId
+// AddSession stores the session without recording a save.
+func (s *sessionMockWrapper) AddSession(c context.Context, cSession session.Session) error {
+	_, err := s.resolver.SaveSession(c, cSession)
+	return err
 }
 
-func (c currentSessionMock) GetCurrentCustomerId() string {
-	return c.CustomerId
+func (s *sessionMockWrapper) SetCollection(collection mock.Collection) *sessionMockWrapper {
+	s.repo.SetCollection(collection)
+	return s
 }
 
-func (c currentSessionMock) GetNow() (time.Time, error) {
-	if c.FakeNow != nil {
-		if t, err := time.Parse(TimeLayoutYYYYMMDD_HHMMSS, *c.FakeNow); err != nil {
-			return time.Time{}, err
-		} else {
-			return t, nil
+func (s *sessionMockWrapper) AddVersion(collectionName string, version string, timedTo time.Time) error {
+	return s.repo.AddVersion(collectionName, version, timedTo)
+}
+
+// Inspection
+
+func (s *sessionMockWrapper) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+func (s *sessionMockWrapper) CallsOf(method string) []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var calls []Call
+	for _, call := range s.calls {
+		if call.Method == method {
+			calls = append(calls, call)
 		}
-	} else {
-		t := time.Now()
-		return t, nil
 	}
+	return calls
 }
 
-func (c currentSessionMock) GetCacheVersions() (map[string]string, error) {
-	return nil, nil
+// Saved returns the snapshots of every save of the session, oldest first.
+func (s *sessionMockWrapper) Saved(sessionId string) []SavedSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var saved []SavedSession
+	for _, savedSession := range s.saved {
+		if savedSession.Id == sessionId {
+			saved = append(saved, savedSession)
+		}
+	}
+	return saved
 }
 
-// Session resolver
-type sessionMockWrapper struct {
-	CurrentSessionToken string
-	CurrentSession      currentSessionMock
+// Reset forgets recorded calls, saves and deletes, stored sessions and stubs are kept.
+func (s *sessionMockWrapper) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = nil
+	s.saved = nil
+	s.deleted = nil
 }
 
-func (s *sessionMockWrapper) SetActiveOrder(c context.Context, subServiceType string, storeId string, timeTo time.Time, tags []string) error {
-	s.CurrentSession.ActiveOrder = &ActiveOrder{
-		SubServiceType: subServiceType,
-		StoreId:        storeId,
-		TimeTo:         timeTo,
-		Tags:           tags,
+// Assertions
+
+func (s *sessionMockWrapper) AssertCalled(t testing.TB, method string) {
+	t.Helper()
+	if len(s.CallsOf(method)) == 0 {
+		t.Errorf("expected %v to be called", method)
 	}
-	return nil
 }
 
-func (s *sessionMockWrapper) VersionsFromSessionToContext(c context.Context) (context.Context, error) {
-	return c, nil
+func (s *sessionMockWrapper) AssertNotCalled(t testing.TB, method string) {
+	t.Helper()
+	if calls := s.CallsOf(method); len(calls) != 0 {
+		t.Errorf("expected %v not to be called, called %v times", method, len(calls))
+	}
 }
 
-func (s *sessionMockWrapper) GetVersionsFromContext(c context.Context) (models.Versions, bool, error) {
-	versions := make(models.Versions)
-	return versions, true, nil
+func (s *sessionMockWrapper) AssertCallCount(t testing.TB, method string, count int) {
+	t.Helper()
+	if calls := s.CallsOf(method); len(calls) != count {
+		t.Errorf("expected %v to be called %v times, called %v times", method, count, len(calls))
+	}
 }
 
-func Test(ao ActiveOrder) error {
-	return nil
+func (s *sessionMockWrapper) AssertSaved(t testing.TB, sessionId string) {
+	t.Helper()
+	if len(s.Saved(sessionId)) == 0 {
+		t.Errorf("expected session %v to be saved", sessionId)
+	}
 }
-func NewSessionMockWrapper(currentSessionToken string, customerId string, activeOrderId string, fakeNow *string,
-	storeId string, timeTo time.Time, tags []string,
-) session.SessionResolver {
-	return &sessionMockWrapper{CurrentSessionToken: currentSessionToken, CurrentSession: currentSessionMock{
-		CustomerId:    customerId,
-		ActiveOrderId: activeOrderId,
-		FakeNow:       fakeNow,
-	}}
+
+func (s *sessionMockWrapper) AssertNotSaved(t testing.TB, sessionId string) {
+	t.Helper()
+	if saved := s.Saved(sessionId); len(saved) != 0 {
+		t.Errorf("expected session %v not to be saved, saved %v times", sessionId, len(saved))
+	}
+}
+
+// AssertSavedWithVersions checks the effective cache versions of the last save of the session.
+func (s *sessionMockWrapper) AssertSavedWithVersions(t testing.TB, sessionId string, versions map[string]string) {
+	t.Helper()
+	saved := s.Saved(sessionId)
+	if len(saved) == 0 {
+		t.Errorf("expected session %v to be saved", sessionId)
+		return
+	}
+	last := saved[len(saved)-1]
+	if !versionsEqual(last.EffectiveCacheVersions, versions) {
+		t.Errorf("session %v was saved with versions %v, expected %v", sessionId, last.EffectiveCacheVersions, versions)
+	}
+}
+
+func (s *sessionMockWrapper) AssertDeleted(t testing.TB, sessionId string) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, deleted := range s.deleted {
+		if deleted == sessionId {
+			return
+		}
+	}
+	t.Errorf("expected session %v to be deleted", sessionId)
+}
+
+// session.SessionResolver
+
+func (s *sessionMockWrapper) SetDataToContext(c context.Context, cSession session.Session) (context.Context, error) {
+	if err := s.call("SetDataToContext", cSession); err != nil {
+		return nil, err
+	}
+	c = s.withTokenData(c)
+	if cSession == nil {
+		var err error
+		if cSession, err = s.currentSession(c); err != nil {
+			return nil, err
+		}
+	}
+	return s.resolver.SetDataToContext(c, cSession)
 }
 
 func (s *sessionMockWrapper) GetSessionById(c context.Context, id string) (bool, session.Session, error) {
-	return true, s.CurrentSession, nil
+	if err := s.call("GetSessionById", id); err != nil {
+		return false, nil, err
+	}
+	c = s.withTokenData(c)
+	return s.resolver.GetSessionById(c, id)
+}
+
+func (s *sessionMockWrapper) GetTokenDataValueAsString(c context.Context, key string) (string, error) {
+	if err := s.call("GetTokenDataValueAsString", key); err != nil {
+		return "", err
+	}
+	return s.tokenDataValue(key)
+}
+
+func (s *sessionMockWrapper) GetNowFromContext(c context.Context) time.Time {
+	_ = s.call("GetNowFromContext")
+	c = s.withTokenData(c)
+	return s.resolver.GetNowFromContext(c)
+}
+
+func (s *sessionMockWrapper) GetVersionFallbacksFromContext(c context.Context) []string {
+	_ = s.call("GetVersionFallbacksFromContext")
+	c = s.withTokenData(c)
+	return s.resolver.GetVersionFallbacksFromContext(c)
+}
+
+func (s *sessionMockWrapper) NewSession(id string) session.Session {
+	_ = s.call("NewSession", id)
+	return s.resolver.NewSession(id)
+}
+
+func (s *sessionMockWrapper) SaveSession(c context.Context, cSession session.Session) (bool, error) {
+	if err := s.call("SaveSession", cSession); err != nil {
+		return false, err
+	}
+	c = s.withTokenData(c)
+	written, err := s.resolver.SaveSession(c, cSession)
+	if err != nil || !written {
+		return written, err
+	}
+	return true, s.recordSave(c, cSession.GetId())
+}
+
+func (s *sessionMockWrapper) PatchSession(c context.Context, cSession session.Session) (bool, error) {
+	if err := s.call("PatchSession", cSession); err != nil {
+		return false, err
+	}
+	c = s.withTokenData(c)
+	written, err := s.resolver.PatchSession(c, cSession)
+	if err != nil || !written {
+		return written, err
+	}
+	return true, s.recordSave(c, cSession.GetId())
+}
+
+func (s *sessionMockWrapper) UpdateSession(c context.Context, id string, update func(session.Session) error) error {
+	if err := s.call("UpdateSession", id); err != nil {
+		return err
+	}
+	c = s.withTokenData(c)
+	revision := s.storedRevision(c, id)
+	if err := s.resolver.UpdateSession(c, id, update); err != nil {
+		return err
+	}
+	return s.recordSaveSince(c, id, revision)
+}
+
+func (s *sessionMockWrapper) DeleteSession(c context.Context, sessionId string) error {
+	if err := s.call("DeleteSession", sessionId); err != nil {
+		return err
+	}
+	c = s.withTokenData(c)
+	return s.deleteSession(c, sessionId)
+}
+
+func (s *sessionMockWrapper) RevokeSession(c context.Context) error {
+	if err := s.call("RevokeSession"); err != nil {
+		return err
+	}
+	c = s.withTokenData(c)
+	sessionId, err := s.tokenDataValue("sessionId")
+	if err != nil {
+		return err
+	}
+	return s.deleteSession(c, sessionId)
+}
+
+func (s *sessionMockWrapper) RotateSession(c context.Context, curSession session.Session) (string, session.Session, error) {
+	if err := s.call("RotateSession", curSession); err != nil {
+		return "", nil, err
+	}
+	c = s.withTokenData(c)
+	newId, rotated, err := s.resolver.RotateSession(c, curSession)
+	if err != nil {
+		return "", nil, err
+	}
+	return newId, rotated, s.recordSave(c, newId)
+}
+
+func (s *sessionMockWrapper) GetCurrentSession(c context.Context) (session.Session, error) {
+	if err := s.call("GetCurrentSession"); err != nil {
+		return nil, err
+	}
+	c = s.withTokenData(c)
+	if cSession, ok := sessionresolver.SessionFromContext(c); ok {
+		return cSession, nil
+	}
+	return s.currentSession(c)
+}
+
+func (s *sessionMockWrapper) ReloadCurrentSession(c context.Context) (session.Session, error) {
+	if err := s.call("ReloadCurrentSession"); err != nil {
+		return nil, err
+	}
+	c = s.withTokenData(c)
+	return s.currentSession(c)
+}
+
+func (s *sessionMockWrapper) FreezeCacheVersionsForSession(c context.Context, curSession session.Session, action string, cacheType string) error {
+	if err := s.call("FreezeCacheVersionsForSession", curSession, action, cacheType); err != nil {
+		return err
+	}
+	c = s.withTokenData(c)
+	revision := s.storedRevision(c, curSession.GetId())
+	if err := s.resolver.FreezeCacheVersionsForSession(c, curSession, action, cacheType); err != nil {
+		return err
+	}
+	return s.recordSaveSince(c, curSession.GetId(), revision)
+}
+
+func (s *sessionMockWrapper) UnFreezeCacheVersionsForSession(c context.Context, curSession session.Session, action string) error {
+	if err := s.call("UnFreezeCacheVersionsForSession", curSession, action); err != nil {
+		return err
+	}
+	c = s.withTokenData(c)
+	revision := s.storedRevision(c, curSession.GetId())
+	if err := s.resolver.UnFreezeCacheVersionsForSession(c, curSession, action); err != nil {
+		return err
+	}
+	return s.recordSaveSince(c, curSession.GetId(), revision)
 }
 
-func (s *sessionMockWrapper) GetCurrentSession(context context.Context) (session.Session, error) {
-	return s.CurrentSession, nil
+func (s *sessionMockWrapper) FreezeCacheVersionsForCollections(c context.Context, curSession session.Session, collections []string) ([]string, error) {
+	if err := s.call("FreezeCacheVersionsForCollections", curSession, collections); err != nil {
+		return nil, err
+	}
+	c = s.withTokenData(c)
+	revision := s.storedRevision(c, curSession.GetId())
+	changed, err := s.resolver.FreezeCacheVersionsForCollections(c, curSession, collections)
+	if err != nil {
+		return nil, err
+	}
+	return changed, s.recordSaveSince(c, curSession.GetId(), revision)
+}
+
+func (s *sessionMockWrapper) UnFreezeCacheVersionsForCollections(c context.Context, curSession session.Session, collections []string) ([]string, error) {
+	if err := s.call("UnFreezeCacheVersionsForCollections", curSession, collections); err != nil {
+		return nil, err
+	}
+	c = s.withTokenData(c)
+	revision := s.storedRevision(c, curSession.GetId())
+	changed, err := s.resolver.UnFreezeCacheVersionsForCollections(c, curSession, collections)
+	if err != nil {
+		return nil, err
+	}
+	return changed, s.recordSaveSince(c, curSession.GetId(), revision)
+}
+
+func (s *sessionMockWrapper) FreezeCacheVersionsForScope(c context.Context, curSession session.Session, scope string, action string, cacheType string, ttl time.Duration) error {
+	if err := s.call("FreezeCacheVersionsForScope", curSession, scope, action, cacheType, ttl); err != nil {
+		return err
+	}
+	c = s.withTokenData(c)
+	revision := s.storedRevision(c, curSession.GetId())
+	if err := s.resolver.FreezeCacheVersionsForScope(c, curSession, scope, action, cacheType, ttl); err != nil {
+		return err
+	}
+	return s.recordSaveSince(c, curSession.GetId(), revision)
 }
 
-func (s *sessionMockWrapper) SetCurrentSession(c context.Context, customerId string, activeOrderId string, fakeNow *string, cacheVersions map[string]string) error {
-	ms := currentSessionMock{
-		CustomerId:    customerId,
-		ActiveOrderId: activeOrderId,
-		FakeNow:       fakeNow,
+func (s *sessionMockWrapper) UnFreezeCacheVersionsForScope(c context.Context, curSession session.Session, scope string) error {
+	if err := s.call("UnFreezeCacheVersionsForScope", curSession, scope); err != nil {
+		return err
 	}
-	s.CurrentSession = ms
+	c = s.withTokenData(c)
+	revision := s.storedRevision(c, curSession.GetId())
+	if err := s.resolver.UnFreezeCacheVersionsForScope(c, curSession, scope); err != nil {
+		return err
+	}
+	return s.recordSaveSince(c, curSession.GetId(), revision)
+}
+
+func (s *sessionMockWrapper) FreezeCacheVersionsForActiveOrder(c context.Context, curSession session.Session, action string, cacheType string) error {
+	if err := s.call("FreezeCacheVersionsForActiveOrder", curSession, action, cacheType); err != nil {
+		return err
+	}
+	c = s.withTokenData(c)
+	revision := s.storedRevision(c, curSession.GetId())
+	if err := s.resolver.FreezeCacheVersionsForActiveOrder(c, curSession, action, cacheType); err != nil {
+		return err
+	}
+	return s.recordSaveSince(c, curSession.GetId(), revision)
+}
+
+func (s *sessionMockWrapper) FreezeCacheVersionsForOrder(c context.Context, curSession session.Session, key string, action string, cacheType string) error {
+	if err := s.call("FreezeCacheVersionsForOrder", curSession, key, action, cacheType); err != nil {
+		return err
+	}
+	c = s.withTokenData(c)
+	revision := s.storedRevision(c, curSession.GetId())
+	if err := s.resolver.FreezeCacheVersionsForOrder(c, curSession, key, action, cacheType); err != nil {
+		return err
+	}
+	return s.recordSaveSince(c, curSession.GetId(), revision)
+}
+
+func (s *sessionMockWrapper) GetVersionsStaleness(c context.Context, curSession session.Session) ([]session.VersionStaleness, error) {
+	if err := s.call("GetVersionsStaleness", curSession); err != nil {
+		return nil, err
+	}
+	c = s.withTokenData(c)
+	return s.resolver.GetVersionsStaleness(c, curSession)
+}
+
+func (s *sessionMockWrapper) IsObsolete(c context.Context, sessionId string) (bool, error) {
+	if err := s.call("IsObsolete", sessionId); err != nil {
+		return false, err
+	}
+	c = s.withTokenData(c)
+	return s.resolver.IsObsolete(c, sessionId)
+}
+
+// call records the call and returns the error stubbed for the method.
+func (s *sessionMockWrapper) call(method string, args ...interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, Call{Method: method, Args: args})
+	return s.errors[method]
+}
+
+func (s *sessionMockWrapper) tokenDataValue(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, ok := s.tokenData[key]
+	if !ok {
+		return "", fmt.Errorf("valueInTokenDataNotFound")
+	}
+	strVal, ok := val.(string)
+	if !ok {
+		return "", fmt.Errorf("valueIsNotString")
+	}
+	return strVal, nil
+}
+
+// withTokenData puts the mock's token data into the context the resolver reads it from,
+// over the token data the context already carries.
+func (s *sessionMockWrapper) withTokenData(c context.Context) context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.tokenData) == 0 {
+		return c
+	}
+	tokenData := make(map[string]interface{})
+	if tokenDataJson, ok := c.Value(tokenauth.TokenDataContextKey).(string); ok {
+		_ = json.Unmarshal([]byte(tokenDataJson), &tokenData)
+	}
+	for key, val := range s.tokenData {
+		tokenData[key] = val
+	}
+	data, err := json.Marshal(tokenData)
+	if err != nil {
+		return c
+	}
+	return context.WithValue(c, tokenauth.TokenDataContextKey, string(data))
+}
+
+func (s *sessionMockWrapper) currentSession(c context.Context) (session.Session, error) {
+	sessionId, err := s.tokenDataValue("sessionId")
+	if err != nil {
+		return nil, err
+	}
+	ok, cSession, err := s.resolver.GetSessionById(c, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, session.ErrSessionNotFound
+	}
+	return cSession, nil
+}
+
+func (s *sessionMockWrapper) deleteSession(c context.Context, sessionId string) error {
+	if err := s.resolver.DeleteSession(c, sessionId); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleted = append(s.deleted, sessionId)
 	return nil
 }
 
-const TimeLayoutYYYYMMDD_HHMMSS = "2006-01-02 15:04:05"
-const DataVersionsKey = "versions"
+// storedRevision returns the revision of the stored session, -1 when there is none.
+func (s *sessionMockWrapper) storedRevision(c context.Context, sessionId string) int64 {
+	ok, stored, err := s.resolver.GetSessionById(c, sessionId)
+	if err != nil || !ok {
+		return -1
+	}
+	return stored.GetRevision()
+}
+
+// recordSaveSince records a save only if the stored session moved past revision.
+func (s *sessionMockWrapper) recordSaveSince(c context.Context, sessionId string, revision int64) error {
+	if s.storedRevision(c, sessionId) == revision {
+		return nil
+	}
+	return s.recordSave(c, sessionId)
+}
+
+// recordSave snapshots the session as it is stored now.
+func (s *sessionMockWrapper) recordSave(c context.Context, sessionId string) error {
+	ok, stored, err := s.resolver.GetSessionById(c, sessionId)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("saved session %v not found", sessionId)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saved = append(s.saved, SavedSession{
+		Id:                     sessionId,
+		CurrentCacheVersions:   stored.GetCurrentCacheVersions(),
+		FixedCacheVersions:     stored.GetFixedCacheVersions(),
+		EffectiveCacheVersions: stored.GetEffectiveCacheVersions(),
+		Session:                stored,
+	})
+	return nil
+}
+
+func versionsEqual(a, b map[string]string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+var _ session.SessionResolver = &sessionMockWrapper{}
@@ -4,10 +4,30 @@ import (
 	"container/list"
 	"fmt"
 	"github.com/orchestd/session"
+	"github.com/orchestd/session/models"
+	"time"
 )
 
+const defaultRotationGracePeriod = 30 * time.Second
+
+const defaultVersionPreviewClaim = "versionPreview"
+
 type SessionResolverConfig struct {
-	Repo session.SessionRepo
+	Repo                session.SessionRepo
+	MaxLifetime         time.Duration
+	IdleTimeout         time.Duration
+	RotationGracePeriod time.Duration
+	Clock               session.Clock
+	FakeNowPolicy       session.FakeNowPolicy
+	FakeNowAuditor      session.FakeNowAuditor
+	VersionFallback     models.VersionFallbackPolicy
+	VersionPreviewClaim string
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
 }
 
 type defaultSessionResolver struct {
@@ -25,8 +45,91 @@ func (cr *defaultSessionResolver) SetRepo(repo session.SessionRepo) session.Sess
 	return cr
 }
 
+// SetMaxLifetime limits how long a session may live since it was created, regardless of activity.
+func (cr *defaultSessionResolver) SetMaxLifetime(maxLifetime time.Duration) session.SessionResolverBuilder {
+	cr.ll.PushBack(func(cfg *SessionResolverConfig) {
+		cfg.MaxLifetime = maxLifetime
+	})
+	return cr
+}
+
+// SetIdleTimeout expires a session that was not accessed for the given duration.
+// Accesses push the expiry forward, reads do so at most once every tenth of the timeout.
+func (cr *defaultSessionResolver) SetIdleTimeout(idleTimeout time.Duration) session.SessionResolverBuilder {
+	cr.ll.PushBack(func(cfg *SessionResolverConfig) {
+		cfg.IdleTimeout = idleTimeout
+	})
+	return cr
+}
+
+// SetRotationGracePeriod sets how long the old id of a rotated session keeps resolving to the new session.
+func (cr *defaultSessionResolver) SetRotationGracePeriod(gracePeriod time.Duration) session.SessionResolverBuilder {
+	cr.ll.PushBack(func(cfg *SessionResolverConfig) {
+		cfg.RotationGracePeriod = gracePeriod
+	})
+	return cr
+}
+
+// SetClock replaces the real time the resolver and its sessions read, e.g. with a controllable clock in tests.
+func (cr *defaultSessionResolver) SetClock(clock session.Clock) session.SessionResolverBuilder {
+	cr.ll.PushBack(func(cfg *SessionResolverConfig) {
+		cfg.Clock = clock
+	})
+	return cr
+}
+
+// SetFakeNowPolicy limits which sessions may use fake time, by default every session may.
+func (cr *defaultSessionResolver) SetFakeNowPolicy(policy session.FakeNowPolicy) session.SessionResolverBuilder {
+	cr.ll.PushBack(func(cfg *SessionResolverConfig) {
+		cfg.FakeNowPolicy = policy
+	})
+	return cr
+}
+
+func (cr *defaultSessionResolver) SetFakeNowAuditor(auditor session.FakeNowAuditor) session.SessionResolverBuilder {
+	cr.ll.PushBack(func(cfg *SessionResolverConfig) {
+		cfg.FakeNowAuditor = auditor
+	})
+	return cr
+}
+
+// SetVersionFallback sets what happens to collections that have no version for the session's date,
+// by default the request fails.
+func (cr *defaultSessionResolver) SetVersionFallback(fallback models.VersionFallback) session.SessionResolverBuilder {
+	cr.ll.PushBack(func(cfg *SessionResolverConfig) {
+		cfg.VersionFallback.Default = fallback
+	})
+	return cr
+}
+
+// SetCollectionVersionFallback overrides SetVersionFallback for a single collection.
+func (cr *defaultSessionResolver) SetCollectionVersionFallback(collectionName string, fallback models.VersionFallback) session.SessionResolverBuilder {
+	cr.ll.PushBack(func(cfg *SessionResolverConfig) {
+		if cfg.VersionFallback.Collections == nil {
+			cfg.VersionFallback.Collections = make(map[string]models.VersionFallback)
+		}
+		cfg.VersionFallback.Collections[collectionName] = fallback
+	})
+	return cr
+}
+
+// SetVersionPreviewClaim sets the token claim that must be true for a session's version preview to apply,
+// an empty claim turns previews off.
+func (cr *defaultSessionResolver) SetVersionPreviewClaim(claim string) session.SessionResolverBuilder {
+	cr.ll.PushBack(func(cfg *SessionResolverConfig) {
+		cfg.VersionPreviewClaim = claim
+	})
+	return cr
+}
+
 func (cr *defaultSessionResolver) Build() (session.SessionResolver, error) {
-	sessionCfg := &SessionResolverConfig{}
+	sessionCfg := &SessionResolverConfig{
+		RotationGracePeriod: defaultRotationGracePeriod,
+		Clock:               realClock{},
+		FakeNowPolicy:       AllowFakeNow(),
+		FakeNowAuditor:      noopFakeNowAuditor{},
+		VersionPreviewClaim: defaultVersionPreviewClaim,
+	}
 	for e := cr.ll.Front(); e != nil; e = e.Next() {
 		f := e.Value.(func(cfg *SessionResolverConfig))
 		f(sessionCfg)
@@ -34,5 +137,25 @@ func (cr *defaultSessionResolver) Build() (session.SessionResolver, error) {
 	if sessionCfg.Repo == nil {
 		return nil, fmt.Errorf("cannot initalize configurations without repo")
 	}
-	return &sessionWrapper{repo: sessionCfg.Repo}, nil
+	if sessionCfg.Clock == nil {
+		return nil, fmt.Errorf("cannot initalize configurations without clock")
+	}
+	if sessionCfg.FakeNowPolicy == nil || sessionCfg.FakeNowAuditor == nil {
+		return nil, fmt.Errorf("cannot initalize configurations without fake now policy and auditor")
+	}
+	if sessionCfg.MaxLifetime < 0 || sessionCfg.IdleTimeout < 0 || sessionCfg.RotationGracePeriod < 0 {
+		return nil, fmt.Errorf("session lifetime, idle timeout and rotation grace period cannot be negative")
+	}
+	return &sessionWrapper{
+		repo:                sessionCfg.Repo,
+		maxLifetime:         sessionCfg.MaxLifetime,
+		idleTimeout:         sessionCfg.IdleTimeout,
+		rotationGracePeriod: sessionCfg.RotationGracePeriod,
+		clock:               sessionCfg.Clock,
+		fakeNowPolicy:       sessionCfg.FakeNowPolicy,
+		fakeNowAuditor:      sessionCfg.FakeNowAuditor,
+		versionFallback:     sessionCfg.VersionFallback,
+		versionPreviewClaim: sessionCfg.VersionPreviewClaim,
+		loads:               newLoadGroup(),
+	}, nil
 }
@@ -0,0 +1,112 @@
+package sessionresolver
+
+import (
+	"context"
+	"github.com/orchestd/session"
+	"github.com/orchestd/session/models"
+	"sync"
+	"time"
+)
+
+type contextKey int
+
+const (
+	versionsContextKey contextKey = iota
+	nowContextKey
+	sessionContextKey
+	versionFallbacksContextKey
+)
+
+// VersionsFromContext returns the cache versions SetDataToContext resolved for the request.
+func VersionsFromContext(c context.Context) (models.Versions, bool) {
+	versions, ok := c.Value(versionsContextKey).(models.Versions)
+	if !ok {
+		return nil, false
+	}
+	result := make(models.Versions)
+	for collection, version := range versions {
+		result[collection] = version
+	}
+	return result, true
+}
+
+// VersionFallbacksFromContext returns the collections that fell back when SetDataToContext resolved the request's versions.
+func VersionFallbacksFromContext(c context.Context) ([]string, bool) {
+	fellBack, ok := c.Value(versionFallbacksContextKey).([]string)
+	return append([]string(nil), fellBack...), ok
+}
+
+// NowFromContext returns the session's time SetDataToContext set for the request.
+func NowFromContext(c context.Context) (time.Time, bool) {
+	now, ok := c.Value(nowContextKey).(time.Time)
+	return now, ok
+}
+
+// SessionFromContext returns the session of the request's token once the request loaded it, see WithSessionMemo.
+func SessionFromContext(c context.Context) (session.Session, bool) {
+	memo := memoFromContext(c)
+	if memo == nil {
+		return nil, false
+	}
+	cSession := memo.get()
+	return cSession, cSession != nil
+}
+
+// WithSessionMemo prepares the request's context to keep the session the first time it is loaded,
+// so following GetCurrentSession calls of the same request return it without reading the repo again.
+// SetDataToContext adds it by itself when it is missing.
+func WithSessionMemo(c context.Context) context.Context {
+	if memoFromContext(c) != nil {
+		return c
+	}
+	return context.WithValue(c, sessionContextKey, &sessionMemo{})
+}
+
+type sessionMemo struct {
+	mu      sync.Mutex
+	session session.Session
+}
+
+func (m *sessionMemo) get() session.Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.session
+}
+
+func (m *sessionMemo) set(cSession session.Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.session = cSession
+}
+
+// forget drops the memoized session if it is the session with the given id.
+func (m *sessionMemo) forget(sessionId string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.session != nil && m.session.GetId() == sessionId {
+		m.session = nil
+	}
+}
+
+func memoFromContext(c context.Context) *sessionMemo {
+	memo, _ := c.Value(sessionContextKey).(*sessionMemo)
+	return memo
+}
+
+func contextWithVersions(c context.Context, versions models.Versions) context.Context {
+	return context.WithValue(c, versionsContextKey, versions)
+}
+
+func contextWithNow(c context.Context, now time.Time) context.Context {
+	return context.WithValue(c, nowContextKey, now)
+}
+
+func contextWithSession(c context.Context, cSession session.Session) context.Context {
+	c = WithSessionMemo(c)
+	memoFromContext(c).set(cSession)
+	return c
+}
+
+func contextWithVersionFallbacks(c context.Context, fellBack []string) context.Context {
+	return context.WithValue(c, versionFallbacksContextKey, fellBack)
+}
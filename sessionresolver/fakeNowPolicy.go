@@ -0,0 +1,59 @@
+package sessionresolver
+
+import (
+	"context"
+	"github.com/orchestd/session"
+	"github.com/orchestd/sharedlib/slices"
+)
+
+// AllowFakeNow lets every session use fake time.
+func AllowFakeNow() session.FakeNowPolicy {
+	return session.FakeNowPolicyFunc(func(c context.Context, curSession session.Session) bool {
+		return true
+	})
+}
+
+// AllowFakeNowInEnvironments lets sessions use fake time only when environment is one of allowed, e.g. "dev" or "qa".
+func AllowFakeNowInEnvironments(environment string, allowed ...string) session.FakeNowPolicy {
+	isAllowed := slices.IsStrExist(allowed, environment)
+	return session.FakeNowPolicyFunc(func(c context.Context, curSession session.Session) bool {
+		return isAllowed
+	})
+}
+
+// AllowFakeNowForCustomers lets only the sessions of the given customers use fake time.
+func AllowFakeNowForCustomers(customerIds ...string) session.FakeNowPolicy {
+	return session.FakeNowPolicyFunc(func(c context.Context, curSession session.Session) bool {
+		return curSession.GetCustomerId() != "" && slices.IsStrExist(customerIds, curSession.GetCustomerId())
+	})
+}
+
+// AllowFakeNowByTokenClaim lets a session use fake time only in requests whose token carries claim set to true.
+func AllowFakeNowByTokenClaim(claim string) session.FakeNowPolicy {
+	return session.FakeNowPolicyFunc(func(c context.Context, curSession session.Session) bool {
+		tokenData, err := tokenDataFromContext(c)
+		if err != nil {
+			return false
+		}
+		allowed, _ := tokenData[claim].(bool)
+		return allowed
+	})
+}
+
+// AnyFakeNowPolicy allows fake time when at least one of the policies allows it.
+func AnyFakeNowPolicy(policies ...session.FakeNowPolicy) session.FakeNowPolicy {
+	return session.FakeNowPolicyFunc(func(c context.Context, curSession session.Session) bool {
+		for _, policy := range policies {
+			if policy.IsFakeNowAllowed(c, curSession) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+type noopFakeNowAuditor struct{}
+
+func (noopFakeNowAuditor) FakeNowChanged(c context.Context, record session.FakeNowAuditRecord) {}
+
+func (noopFakeNowAuditor) FakeNowIgnored(c context.Context, curSession session.Session) {}
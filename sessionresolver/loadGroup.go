@@ -0,0 +1,73 @@
+package sessionresolver
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+type loadCall struct {
+	wg   sync.WaitGroup
+	ok   bool
+	s    *currentSession
+	err  error
+	dups int
+}
+
+// loadGroup coalesces concurrent loads of the same session id into a single repo round trip.
+// The loaded session is never handed out itself once it is shared, every caller gets its own copy.
+type loadGroup struct {
+	mu    sync.Mutex
+	calls map[string]*loadCall
+}
+
+func newLoadGroup() *loadGroup {
+	return &loadGroup{calls: make(map[string]*loadCall)}
+}
+
+// do runs load with the context of the first caller of id and shares its result with the callers that come meanwhile.
+// A waiter whose own context is still alive does not take the first caller's cancellation, it loads again itself.
+func (g *loadGroup) do(c context.Context, id string, load func(c context.Context) (bool, *currentSession, error)) (bool, *currentSession, error) {
+	g.mu.Lock()
+	if call, ok := g.calls[id]; ok {
+		call.dups++
+		g.mu.Unlock()
+		call.wg.Wait()
+		if isContextError(call.err) && c.Err() == nil {
+			return load(c)
+		}
+		return copyLoaded(call.ok, call.s, call.err)
+	}
+	call := &loadCall{}
+	call.wg.Add(1)
+	g.calls[id] = call
+	g.mu.Unlock()
+
+	call.ok, call.s, call.err = load(c)
+
+	g.mu.Lock()
+	delete(g.calls, id)
+	shared := call.dups > 0
+	g.mu.Unlock()
+	call.wg.Done()
+
+	if shared {
+		return copyLoaded(call.ok, call.s, call.err)
+	}
+	return call.ok, call.s, call.err
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func copyLoaded(ok bool, s *currentSession, err error) (bool, *currentSession, error) {
+	if err != nil || !ok {
+		return ok, nil, err
+	}
+	cloned, err := s.clone()
+	if err != nil {
+		return false, nil, err
+	}
+	return true, cloned, nil
+}
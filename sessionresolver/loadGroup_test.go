@@ -0,0 +1,124 @@
+package sessionresolver
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForDups blocks until n callers joined the load of id that is in flight.
+func waitForDups(t *testing.T, g *loadGroup, id string, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		g.mu.Lock()
+		call, ok := g.calls[id]
+		joined := ok && call.dups >= n
+		g.mu.Unlock()
+		if joined {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v callers did not join the load of %v", n, id)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLoadGroupSharesOneLoad(t *testing.T) {
+	g := newLoadGroup()
+	release := make(chan struct{})
+	loads := 0
+	load := func(c context.Context) (bool, *currentSession, error) {
+		loads++
+		<-release
+		return true, &currentSession{Id: "s1", Lang: "en"}, nil
+	}
+
+	const waiters = 5
+	results := make([]*currentSession, waiters+1)
+	var wg sync.WaitGroup
+	for i := 0; i <= waiters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, s, err := g.do(context.Background(), "s1", load)
+			if err != nil || !ok {
+				t.Errorf("load returned ok %v error %v", ok, err)
+				return
+			}
+			results[i] = s
+		}(i)
+		if i == 0 {
+			// let the first caller start the load before the others join it
+			for {
+				g.mu.Lock()
+				_, started := g.calls["s1"]
+				g.mu.Unlock()
+				if started {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	waitForDups(t, g, "s1", waiters)
+	close(release)
+	wg.Wait()
+
+	if loads != 1 {
+		t.Fatalf("expected a single load, got %v", loads)
+	}
+	seen := make(map[*currentSession]bool)
+	for _, s := range results {
+		if s == nil || s.Lang != "en" {
+			t.Fatalf("caller got %+v", s)
+		}
+		if seen[s] {
+			t.Fatal("callers share the loaded session")
+		}
+		seen[s] = true
+	}
+}
+
+func TestLoadGroupRetriesAfterLeaderCancel(t *testing.T) {
+	g := newLoadGroup()
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	leaderDone := make(chan error, 1)
+	go func() {
+		_, _, err := g.do(leaderCtx, "s1", func(c context.Context) (bool, *currentSession, error) {
+			close(started)
+			<-c.Done()
+			return false, nil, c.Err()
+		})
+		leaderDone <- err
+	}()
+	<-started
+
+	waiterDone := make(chan error, 1)
+	var waiterSession *currentSession
+	go func() {
+		ok, s, err := g.do(context.Background(), "s1", func(c context.Context) (bool, *currentSession, error) {
+			return true, &currentSession{Id: "s1"}, c.Err()
+		})
+		if err == nil && !ok {
+			err = errors.New("session not found")
+		}
+		waiterSession = s
+		waiterDone <- err
+	}()
+	waitForDups(t, g, "s1", 1)
+	cancel()
+
+	if err := <-leaderDone; !errors.Is(err, context.Canceled) {
+		t.Fatalf("leader expected to be cancelled, got %v", err)
+	}
+	if err := <-waiterDone; err != nil {
+		t.Fatalf("waiter took the leader's cancellation: %v", err)
+	}
+	if waiterSession == nil || waiterSession.Id != "s1" {
+		t.Fatalf("waiter got %+v", waiterSession)
+	}
+}
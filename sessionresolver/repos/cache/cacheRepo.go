@@ -2,9 +2,10 @@ package cache
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"github.com/orchestd/cacheStorage"
 	"github.com/orchestd/dependencybundler/interfaces/cache"
+	"github.com/orchestd/session/models"
 	"github.com/orchestd/sharedlib/slices"
 	"time"
 )
@@ -14,10 +15,12 @@ type cacheRepo struct {
 	cacheSetter           cache.CacheStorageSetterWrapper
 	sessionCollectionName string
 	version               string
+	locks                 *idLocks
+	snapshot              *snapshotHolder
 }
 
 func NewSessionCacheRepo(cacheGetter cache.CacheStorageGetterWrapper, cacheSetter cache.CacheStorageSetterWrapper, collectionName string, version string) *cacheRepo {
-	return &cacheRepo{cacheGetter: cacheGetter, cacheSetter: cacheSetter, sessionCollectionName: collectionName, version: version}
+	return &cacheRepo{cacheGetter: cacheGetter, cacheSetter: cacheSetter, sessionCollectionName: collectionName, version: version, locks: &idLocks{}, snapshot: &snapshotHolder{}}
 }
 
 func (r cacheRepo) GetUserSessionByTokenToStruct(c context.Context, token string, dest interface{}) (bool, error) {
@@ -36,45 +39,181 @@ func (r cacheRepo) InsertOrUpdate(ctx context.Context, id string, obj interface{
 	return r.cacheSetter.InsertOrUpdate(ctx, r.sessionCollectionName, id, r.version, obj)
 }
 
+// CompareAndSwap reads the stored revision and writes obj under a per id lock.
+// The cache storage has no conditional write, so the check only holds against writers in this process.
+func (r cacheRepo) CompareAndSwap(ctx context.Context, id string, revision int64, obj interface{}) (bool, error) {
+	lock := r.locks.get(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	var stored models.Revision
+	found, err := r.GetUserSessionByTokenToStruct(ctx, id, &stored)
+	if err != nil {
+		return false, err
+	}
+	if stored.Revision != revision || (!found && revision != 0) {
+		return false, nil
+	}
+	if err := r.InsertOrUpdate(ctx, id, obj); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Patch rewrites the stored object with the given fields under the same per id lock as CompareAndSwap,
+// so like CompareAndSwap it is atomic only against writers in this process.
+func (r cacheRepo) Patch(ctx context.Context, id string, fields map[string]interface{}) (bool, int64, error) {
+	lock := r.locks.get(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	stored := make(map[string]json.RawMessage)
+	found, err := r.GetUserSessionByTokenToStruct(ctx, id, &stored)
+	if err != nil || !found {
+		return false, 0, err
+	}
+	if err := setFields(stored, fields); err != nil {
+		return false, 0, err
+	}
+	revision, err := bumpRevision(stored)
+	if err != nil {
+		return false, 0, err
+	}
+	if err := r.InsertOrUpdate(ctx, id, stored); err != nil {
+		return false, 0, err
+	}
+	return true, revision, nil
+}
+
+// Touch rewrites the stored object with the given fields under the per id lock, keeping its revision.
+func (r cacheRepo) Touch(ctx context.Context, id string, fields map[string]interface{}) (bool, error) {
+	lock := r.locks.get(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	stored := make(map[string]json.RawMessage)
+	found, err := r.GetUserSessionByTokenToStruct(ctx, id, &stored)
+	if err != nil || !found {
+		return false, err
+	}
+	if err := setFields(stored, fields); err != nil {
+		return false, err
+	}
+	if err := r.InsertOrUpdate(ctx, id, stored); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func setFields(stored map[string]json.RawMessage, fields map[string]interface{}) error {
+	for field, value := range fields {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		stored[field] = data
+	}
+	return nil
+}
+
+func bumpRevision(stored map[string]json.RawMessage) (int64, error) {
+	var current models.Revision
+	if data, ok := stored["Revision"]; ok {
+		if err := json.Unmarshal(data, &current.Revision); err != nil {
+			return 0, err
+		}
+	}
+	current.Revision++
+	data, err := json.Marshal(current.Revision)
+	if err != nil {
+		return 0, err
+	}
+	stored["Revision"] = data
+	return current.Revision, nil
+}
+
+func (r cacheRepo) Delete(ctx context.Context, id string) error {
+	err := r.cacheSetter.Remove(ctx, r.sessionCollectionName, id, r.version)
+	if err != nil {
+		if err.IsNotFound() {
+			return nil
+		} else {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r cacheRepo) GetVersionsHistory(ctx context.Context) (map[string][]models.TimedVersion, error) {
+	snapshot, err := r.versionsSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]models.TimedVersion)
+	for _, collection := range snapshot.collections {
+		history := make([]models.TimedVersion, 0, len(collection.versions))
+		for _, v := range collection.versions {
+			history = append(history, models.TimedVersion{Version: v.Version, TimedTo: v.TimedTo})
+		}
+		result[collection.collectionName] = history
+	}
+	return result, nil
+}
+
 func (r cacheRepo) GetCollectionsFilterActions(ctx context.Context, filterAction string) ([]string, error) {
-	cacheCollections, err := r.cacheGetter.GetLatestVersions(ctx)
+	snapshot, err := r.versionsSnapshot(ctx)
 	if err != nil {
 		return nil, err
 	}
 	result := []string{}
-	for _, cacheCollection := range cacheCollections {
-		if filterAction != "" && !slices.IsStrExist(cacheCollection.LockVersionUpon, filterAction) {
+	for _, collection := range snapshot.collections {
+		if filterAction != "" && !slices.IsStrExist(collection.lockVersionUpon, filterAction) {
 			continue
 		}
-		result = append(result, cacheCollection.CollectionName)
+		result = append(result, collection.collectionName)
 	}
-	return result, err
+	return result, nil
 }
 
 func (r cacheRepo) GetCacheVersions(ctx context.Context, now time.Time, filterAction string, filterType string) (map[string]string, error) {
-	cacheCollections, err := r.cacheGetter.GetLatestVersions(ctx)
+	result, _, err := r.GetCacheVersionsWithFallback(ctx, now, filterAction, filterType, models.VersionFallbackPolicy{})
+	return result, err
+}
+
+// GetCacheVersionsWithFallback is GetCacheVersions that applies fallback to collections without a version for now,
+// and also returns the collections that fell back.
+func (r cacheRepo) GetCacheVersionsWithFallback(ctx context.Context, now time.Time, filterAction string, filterType string, fallback models.VersionFallbackPolicy) (map[string]string, []string, error) {
+	snapshot, err := r.versionsSnapshot(ctx)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	result := make(map[string]string)
+	fellBack := []string{}
 
-	for _, cacheCollection := range cacheCollections {
-		if filterAction != "" && !slices.IsStrExist(cacheCollection.LockVersionUpon, filterAction) {
+	for _, collection := range snapshot.collections {
+		if filterAction != "" && !slices.IsStrExist(collection.lockVersionUpon, filterAction) {
 			continue
 		}
-		if filterType != "" && cacheCollection.CacheType != filterType {
+		if filterType != "" && collection.cacheType != filterType {
 			continue
 		}
-		var latestVersion cacheStorage.Version
-		for _, v := range cacheCollection.Versions {
-			if (latestVersion.TimedTo.IsZero() || v.TimedTo.After(latestVersion.TimedTo)) && v.TimedTo.Before(now) {
-				latestVersion = v
-			}
+		latestVersion, ok := collection.versionAt(now)
+		if ok && latestVersion.Version != "" {
+			result[collection.collectionName] = latestVersion.Version
+			continue
 		}
-		if latestVersion.Version == "" {
-			return result, fmt.Errorf("no version found for collection %v by date %v", cacheCollection.CollectionName, now)
+		switch fallback.For(collection.collectionName) {
+		case models.SkipCollection:
+			fellBack = append(fellBack, collection.collectionName)
+			continue
+		case models.UseOldestVersion:
+			if len(collection.versions) > 0 && collection.versions[0].Version != "" {
+				result[collection.collectionName] = collection.versions[0].Version
+				fellBack = append(fellBack, collection.collectionName)
+				continue
+			}
 		}
-		result[cacheCollection.CollectionName] = latestVersion.Version
+		return result, fellBack, fmt.Errorf("no version found for collection %v by date %v", collection.collectionName, now)
 	}
-	return result, nil
+	return result, fellBack, nil
 }
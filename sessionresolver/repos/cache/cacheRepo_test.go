@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/orchestd/cacheStorage"
+	"github.com/orchestd/dependencybundler/interfaces/cache"
+	"github.com/orchestd/session"
+	"github.com/orchestd/session/sessiontest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeStorageError struct {
+	cacheStorage.CacheStorageError
+	notFound bool
+	message  string
+}
+
+func (e fakeStorageError) Error() string {
+	return e.message
+}
+
+func (e fakeStorageError) IsNotFound() bool {
+	return e.notFound
+}
+
+// fakeCacheStorage keeps items JSON encoded the way the cache storage does,
+// so a stored map[string]json.RawMessage is read back as a session and the other way around.
+type fakeCacheStorage struct {
+	mu          sync.Mutex
+	items       map[string][]byte
+	collections []cacheStorage.CacheVersions
+}
+
+func newFakeCacheStorage(collections []cacheStorage.CacheVersions) *fakeCacheStorage {
+	return &fakeCacheStorage{items: make(map[string][]byte), collections: collections}
+}
+
+func (f *fakeCacheStorage) key(collectionName string, id interface{}, ver string) string {
+	return fmt.Sprintf("%v/%v/%v", collectionName, ver, id)
+}
+
+// fakeGetter and fakeSetter embed the wrapper interfaces for the methods the repo never calls.
+type fakeGetter struct {
+	cache.CacheStorageGetterWrapper
+	storage *fakeCacheStorage
+}
+
+func (g fakeGetter) GetById(c context.Context, collectionName string, id interface{}, ver string, dest interface{}) cacheStorage.CacheStorageError {
+	g.storage.mu.Lock()
+	data, ok := g.storage.items[g.storage.key(collectionName, id, ver)]
+	g.storage.mu.Unlock()
+	if !ok {
+		return fakeStorageError{notFound: true, message: "not found"}
+	}
+	if err := json.Unmarshal(data, dest); err != nil {
+		return fakeStorageError{message: err.Error()}
+	}
+	return nil
+}
+
+func (g fakeGetter) GetLatestVersions(c context.Context) ([]cacheStorage.CacheVersions, cacheStorage.CacheStorageError) {
+	g.storage.mu.Lock()
+	defer g.storage.mu.Unlock()
+	return g.storage.collections, nil
+}
+
+type fakeSetter struct {
+	cache.CacheStorageSetterWrapper
+	storage *fakeCacheStorage
+}
+
+func (s fakeSetter) InsertOrUpdate(c context.Context, collectionName string, id string, ver string, item interface{}) cacheStorage.CacheStorageError {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return fakeStorageError{message: err.Error()}
+	}
+	s.storage.mu.Lock()
+	defer s.storage.mu.Unlock()
+	s.storage.items[s.storage.key(collectionName, id, ver)] = data
+	return nil
+}
+
+func (s fakeSetter) Remove(c context.Context, collectionName string, id string, ver string) cacheStorage.CacheStorageError {
+	s.storage.mu.Lock()
+	defer s.storage.mu.Unlock()
+	key := s.storage.key(collectionName, id, ver)
+	if _, ok := s.storage.items[key]; !ok {
+		return fakeStorageError{notFound: true, message: "not found"}
+	}
+	delete(s.storage.items, key)
+	return nil
+}
+
+func newTestCacheRepo(collections []cacheStorage.CacheVersions) *cacheRepo {
+	storage := newFakeCacheStorage(collections)
+	return NewSessionCacheRepo(fakeGetter{storage: storage}, fakeSetter{storage: storage}, "sessions", "1")
+}
+
+func TestCacheRepo(t *testing.T) {
+	sessiontest.RunRepoSuite(t, func(t *testing.T, collections []cacheStorage.CacheVersions) session.SessionRepo {
+		return newTestCacheRepo(collections)
+	})
+}
+
+func TestCacheRepoWithVersionsSnapshot(t *testing.T) {
+	sessiontest.RunRepoSuite(t, func(t *testing.T, collections []cacheStorage.CacheVersions) session.SessionRepo {
+		repo := newTestCacheRepo(collections)
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		if err := repo.StartVersionsSnapshot(ctx, time.Minute); err != nil {
+			t.Fatalf("start versions snapshot failed: %v", err)
+		}
+		return repo
+	})
+}
@@ -0,0 +1,16 @@
+package cache
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// idLocks serializes read-modify-write cycles on the same id within this process.
+// Ids are spread over a fixed number of mutexes, so unrelated ids may occasionally share one.
+type idLocks [64]sync.Mutex
+
+func (l *idLocks) get(id string) *sync.Mutex {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	return &l[h.Sum32()%uint32(len(l))]
+}
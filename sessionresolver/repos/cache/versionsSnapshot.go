@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"github.com/orchestd/cacheStorage"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+type collectionVersions struct {
+	collectionName  string
+	cacheType       string
+	lockVersionUpon []string
+	// versions are ordered by TimedTo, with a single version for every TimedTo
+	versions []cacheStorage.Version
+}
+
+// versionAt returns the latest version timed before now.
+func (cv collectionVersions) versionAt(now time.Time) (cacheStorage.Version, bool) {
+	i := sort.Search(len(cv.versions), func(i int) bool {
+		return !cv.versions[i].TimedTo.Before(now)
+	})
+	if i == 0 {
+		return cacheStorage.Version{}, false
+	}
+	return cv.versions[i-1], true
+}
+
+type versionsSnapshot struct {
+	collections []collectionVersions
+	takenAt     time.Time
+	// maxAge is how long the snapshot may be served, after it the versions are read from the cache storage again
+	maxAge time.Duration
+}
+
+func (s *versionsSnapshot) isFresh(now time.Time) bool {
+	return now.Sub(s.takenAt) <= s.maxAge
+}
+
+type snapshotHolder struct {
+	snapshot atomic.Value
+}
+
+func (h *snapshotHolder) get() *versionsSnapshot {
+	snapshot, _ := h.snapshot.Load().(*versionsSnapshot)
+	return snapshot
+}
+
+func (h *snapshotHolder) set(snapshot *versionsSnapshot) {
+	h.snapshot.Store(snapshot)
+}
+
+func (r cacheRepo) takeVersionsSnapshot(ctx context.Context) (*versionsSnapshot, error) {
+	cacheCollections, err := r.cacheGetter.GetLatestVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &versionsSnapshot{takenAt: time.Now()}
+	for _, cacheCollection := range cacheCollections {
+		versions := append([]cacheStorage.Version(nil), cacheCollection.Versions...)
+		sort.SliceStable(versions, func(i, j int) bool {
+			return versions[i].TimedTo.Before(versions[j].TimedTo)
+		})
+		// of versions timed to the same moment the first one listed wins, as it always did
+		unique := versions[:0]
+		for _, v := range versions {
+			if len(unique) > 0 && unique[len(unique)-1].TimedTo.Equal(v.TimedTo) {
+				continue
+			}
+			unique = append(unique, v)
+		}
+		snapshot.collections = append(snapshot.collections, collectionVersions{
+			collectionName:  cacheCollection.CollectionName,
+			cacheType:       cacheCollection.CacheType,
+			lockVersionUpon: cacheCollection.LockVersionUpon,
+			versions:        unique,
+		})
+	}
+	return snapshot, nil
+}
+
+// versionsSnapshot returns the snapshot kept by StartVersionsSnapshot,
+// or a fresh one when it was not started, was stopped or could not be refreshed in time.
+func (r cacheRepo) versionsSnapshot(ctx context.Context) (*versionsSnapshot, error) {
+	if snapshot := r.snapshot.get(); snapshot != nil && snapshot.isFresh(time.Now()) {
+		return snapshot, nil
+	}
+	return r.takeVersionsSnapshot(ctx)
+}
+
+// StartVersionsSnapshot keeps the cache versions in process and refreshes them every refreshInterval
+// in the background until ctx is done, so resolving versions does not read the cache storage on every request.
+// Versions published in the cache storage become visible within refreshInterval.
+// A snapshot that failed to refresh for two intervals is no longer served,
+// and once ctx is done the versions are read from the cache storage again.
+func (r cacheRepo) StartVersionsSnapshot(ctx context.Context, refreshInterval time.Duration) error {
+	if refreshInterval <= 0 {
+		return fmt.Errorf("versions snapshot refresh interval must be positive")
+	}
+	// a refresh is due every interval, the second one gives a slow refresh time to land
+	maxAge := 2 * refreshInterval
+	snapshot, err := r.takeVersionsSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	snapshot.maxAge = maxAge
+	r.snapshot.set(snapshot)
+
+	go func() {
+		ticker := time.NewTicker(refreshInterval)
+		defer ticker.Stop()
+		defer r.snapshot.set(nil)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if snapshot, err := r.takeVersionsSnapshot(ctx); err == nil {
+					snapshot.maxAge = maxAge
+					r.snapshot.set(snapshot)
+				}
+			}
+		}
+	}()
+	return nil
+}
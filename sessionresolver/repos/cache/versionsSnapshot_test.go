@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"context"
+	"github.com/orchestd/cacheStorage"
+	"testing"
+	"time"
+)
+
+var snapshotNow = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func TestVersionAt(t *testing.T) {
+	repo := newTestCacheRepo([]cacheStorage.CacheVersions{{
+		CollectionName: "menu",
+		Versions: []cacheStorage.Version{
+			{Version: "menu-3", TimedTo: snapshotNow.Add(time.Hour)},
+			{Version: "menu-1", TimedTo: snapshotNow.Add(-2 * time.Hour)},
+			{Version: "menu-2a", TimedTo: snapshotNow.Add(-time.Hour)},
+			{Version: "menu-2b", TimedTo: snapshotNow.Add(-time.Hour)},
+		},
+	}})
+	snapshot, err := repo.takeVersionsSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("take versions snapshot failed: %v", err)
+	}
+	collection := snapshot.collections[0]
+	if len(collection.versions) != 3 {
+		t.Fatalf("versions timed to the same moment were not merged: %v", collection.versions)
+	}
+
+	tests := []struct {
+		now      time.Time
+		expected string
+	}{
+		{snapshotNow.Add(-3 * time.Hour), ""},
+		{snapshotNow.Add(-2 * time.Hour), ""},
+		{snapshotNow.Add(-90 * time.Minute), "menu-1"},
+		{snapshotNow.Add(-time.Hour), "menu-1"},
+		{snapshotNow, "menu-2a"},
+		{snapshotNow.Add(2 * time.Hour), "menu-3"},
+	}
+	for _, test := range tests {
+		version, ok := collection.versionAt(test.now)
+		if ok != (test.expected != "") || version.Version != test.expected {
+			t.Errorf("version at %v is %q, expected %q", test.now, version.Version, test.expected)
+		}
+	}
+}
+
+func TestVersionsSnapshotRefresh(t *testing.T) {
+	storage := newFakeCacheStorage([]cacheStorage.CacheVersions{{
+		CollectionName: "menu",
+		Versions:       []cacheStorage.Version{{Version: "menu-1", TimedTo: snapshotNow}},
+	}})
+	repo := NewSessionCacheRepo(fakeGetter{storage: storage}, fakeSetter{storage: storage}, "sessions", "1")
+	if err := repo.StartVersionsSnapshot(context.Background(), 0); err == nil {
+		t.Fatalf("expected an error for a refresh interval that is not positive")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := repo.StartVersionsSnapshot(ctx, time.Hour); err != nil {
+		t.Fatalf("start versions snapshot failed: %v", err)
+	}
+	storage.mu.Lock()
+	storage.collections = []cacheStorage.CacheVersions{{
+		CollectionName: "menu",
+		Versions:       []cacheStorage.Version{{Version: "menu-2", TimedTo: snapshotNow}},
+	}}
+	storage.mu.Unlock()
+	assertMenuVersion(t, repo, "menu-1")
+
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for repo.snapshot.get() != nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assertMenuVersion(t, repo, "menu-2")
+}
+
+func TestVersionsSnapshotMaxAge(t *testing.T) {
+	repo := newTestCacheRepo(nil)
+	repo.snapshot.set(&versionsSnapshot{takenAt: time.Now().Add(-time.Hour), maxAge: time.Minute})
+	snapshot, err := repo.versionsSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("get versions snapshot failed: %v", err)
+	}
+	if snapshot == repo.snapshot.get() {
+		t.Fatalf("a snapshot older than its max age was served")
+	}
+}
+
+func assertMenuVersion(t *testing.T, repo *cacheRepo, expected string) {
+	t.Helper()
+	versions, err := repo.GetCacheVersions(context.Background(), snapshotNow.Add(time.Minute), "", "")
+	if err != nil {
+		t.Fatalf("get cache versions failed: %v", err)
+	}
+	if versions["menu"] != expected {
+		t.Fatalf("menu version is %v, expected %v", versions["menu"], expected)
+	}
+}
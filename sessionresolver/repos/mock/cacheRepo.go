@@ -4,43 +4,264 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/orchestd/cacheStorage"
+	"github.com/orchestd/session"
+	"github.com/orchestd/session/models"
+	"github.com/orchestd/sharedlib/slices"
+	"sort"
+	"sync"
+	"time"
 )
 
+// Collection mirrors the version metadata the cache storage keeps for a cached collection.
+type Collection struct {
+	CollectionName  string
+	CacheType       string
+	LockVersionUpon []string
+	Versions        []cacheStorage.Version
+}
+
+// cacheRepoMock is an in memory session.SessionRepo, safe for concurrent use.
+// Sessions are kept JSON encoded, so callers never share state with the stored copy.
 type cacheRepoMock struct {
-	versions map[string]string
-	sessions map[string]interface{}
+	mu          sync.RWMutex
+	sessions    map[string][]byte
+	collections map[string]Collection
+}
+
+func NewCacheRepoMock(collections ...Collection) *cacheRepoMock {
+	c := &cacheRepoMock{
+		sessions:    make(map[string][]byte),
+		collections: make(map[string]Collection),
+	}
+	for _, collection := range collections {
+		c.SetCollection(collection)
+	}
+	return c
+}
+
+// SetCollection adds the collection or replaces the one with the same name.
+func (c *cacheRepoMock) SetCollection(collection Collection) {
+	collection.LockVersionUpon = append([]string(nil), collection.LockVersionUpon...)
+	collection.Versions = append([]cacheStorage.Version(nil), collection.Versions...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.collections[collection.CollectionName] = collection
 }
 
-func (c cacheRepoMock) GetUserSessionByTokenToStruct(context context.Context, token string, dest interface{}) error {
-	val, ok := c.sessions[token]
+func (c *cacheRepoMock) AddVersion(collectionName string, version string, timedTo time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	collection, ok := c.collections[collectionName]
 	if !ok {
-		return fmt.Errorf("notFound")
+		return fmt.Errorf("collection %v not found", collectionName)
 	}
-	data, err := json.Marshal(val)
-	if err != nil {
-		return err
+	collection.Versions = append(collection.Versions, cacheStorage.Version{Version: version, TimedTo: timedTo})
+	c.collections[collectionName] = collection
+	return nil
+}
+
+func (c *cacheRepoMock) GetUserSessionByTokenToStruct(ctx context.Context, token string, dest interface{}) (bool, error) {
+	c.mu.RLock()
+	data, ok := c.sessions[token]
+	c.mu.RUnlock()
+	if !ok {
+		return false, nil
 	}
 	if err := json.Unmarshal(data, dest); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *cacheRepoMock) InsertOrUpdate(ctx context.Context, id string, obj interface{}) error {
+	data, err := marshalSession(obj)
+	if err != nil {
 		return err
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sessions[id] = data
 	return nil
 }
 
-func (c cacheRepoMock) InsertOrUpdate(ctx context.Context, id string, obj interface{}) error {
-	if obj == nil {
-		return fmt.Errorf("cannotInsertNilObject")
+func (c *cacheRepoMock) CompareAndSwap(ctx context.Context, id string, revision int64, obj interface{}) (bool, error) {
+	data, err := marshalSession(obj)
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var stored models.Revision
+	storedData, found := c.sessions[id]
+	if found {
+		if err := json.Unmarshal(storedData, &stored); err != nil {
+			return false, err
+		}
+	}
+	if stored.Revision != revision || (!found && revision != 0) {
+		return false, nil
+	}
+	c.sessions[id] = data
+	return true, nil
+}
+
+func (c *cacheRepoMock) Patch(ctx context.Context, id string, fields map[string]interface{}) (bool, int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	storedData, found := c.sessions[id]
+	if !found {
+		return false, 0, nil
+	}
+	stored, err := setFields(storedData, fields)
+	if err != nil {
+		return false, 0, err
+	}
+	var revision models.Revision
+	if err := json.Unmarshal(storedData, &revision); err != nil {
+		return false, 0, err
 	}
-	c.sessions[id] = obj
+	revision.Revision++
+	stored["Revision"], _ = json.Marshal(revision.Revision)
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return false, 0, err
+	}
+	c.sessions[id] = data
+	return true, revision.Revision, nil
+}
+
+func (c *cacheRepoMock) Touch(ctx context.Context, id string, fields map[string]interface{}) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	storedData, found := c.sessions[id]
+	if !found {
+		return false, nil
+	}
+	stored, err := setFields(storedData, fields)
+	if err != nil {
+		return false, err
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return false, err
+	}
+	c.sessions[id] = data
+	return true, nil
+}
+
+func setFields(storedData []byte, fields map[string]interface{}) (map[string]json.RawMessage, error) {
+	stored := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(storedData, &stored); err != nil {
+		return nil, err
+	}
+	for field, value := range fields {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		stored[field] = data
+	}
+	return stored, nil
+}
+
+func (c *cacheRepoMock) Delete(ctx context.Context, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.sessions, id)
 	return nil
 }
 
-func (c cacheRepoMock) GetCacheVersions(ctx context.Context) (map[string]string, error) {
-	return c.versions , nil
+func (c *cacheRepoMock) GetVersionsHistory(ctx context.Context) (map[string][]models.TimedVersion, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	result := make(map[string][]models.TimedVersion)
+	for _, collection := range c.collections {
+		history := make([]models.TimedVersion, 0, len(collection.Versions))
+		for _, v := range collection.Versions {
+			history = append(history, models.TimedVersion{Version: v.Version, TimedTo: v.TimedTo})
+		}
+		sort.SliceStable(history, func(i, j int) bool {
+			return history[i].TimedTo.Before(history[j].TimedTo)
+		})
+		// of versions timed to the same moment the first one listed wins, like in GetCacheVersions
+		unique := history[:0]
+		for _, v := range history {
+			if len(unique) > 0 && unique[len(unique)-1].TimedTo.Equal(v.TimedTo) {
+				continue
+			}
+			unique = append(unique, v)
+		}
+		result[collection.CollectionName] = unique
+	}
+	return result, nil
 }
 
-func NewCacheRepoMock(versionsFakeData map[string]string , sessionsFakeData map[string]interface{}) *cacheRepoMock {
-	return &cacheRepoMock{
-		versions: versionsFakeData,
-		sessions: sessionsFakeData,
+func (c *cacheRepoMock) GetCollectionsFilterActions(ctx context.Context, filterAction string) ([]string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	result := []string{}
+	for _, collection := range c.collections {
+		if filterAction != "" && !slices.IsStrExist(collection.LockVersionUpon, filterAction) {
+			continue
+		}
+		result = append(result, collection.CollectionName)
 	}
+	return result, nil
+}
+
+func (c *cacheRepoMock) GetCacheVersions(ctx context.Context, now time.Time, filterAction string, filterType string) (map[string]string, error) {
+	result, _, err := c.GetCacheVersionsWithFallback(ctx, now, filterAction, filterType, models.VersionFallbackPolicy{})
+	return result, err
 }
+
+func (c *cacheRepoMock) GetCacheVersionsWithFallback(ctx context.Context, now time.Time, filterAction string, filterType string, fallback models.VersionFallbackPolicy) (map[string]string, []string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	result := make(map[string]string)
+	fellBack := []string{}
+
+	for _, collection := range c.collections {
+		if filterAction != "" && !slices.IsStrExist(collection.LockVersionUpon, filterAction) {
+			continue
+		}
+		if filterType != "" && collection.CacheType != filterType {
+			continue
+		}
+		var latestVersion, oldestVersion cacheStorage.Version
+		for _, v := range collection.Versions {
+			if (latestVersion.TimedTo.IsZero() || v.TimedTo.After(latestVersion.TimedTo)) && v.TimedTo.Before(now) {
+				latestVersion = v
+			}
+			if oldestVersion.TimedTo.IsZero() || v.TimedTo.Before(oldestVersion.TimedTo) {
+				oldestVersion = v
+			}
+		}
+		if latestVersion.Version != "" {
+			result[collection.CollectionName] = latestVersion.Version
+			continue
+		}
+		switch fallback.For(collection.CollectionName) {
+		case models.SkipCollection:
+			fellBack = append(fellBack, collection.CollectionName)
+			continue
+		case models.UseOldestVersion:
+			if oldestVersion.Version != "" {
+				result[collection.CollectionName] = oldestVersion.Version
+				fellBack = append(fellBack, collection.CollectionName)
+				continue
+			}
+		}
+		return result, fellBack, fmt.Errorf("no version found for collection %v by date %v", collection.CollectionName, now)
+	}
+	return result, fellBack, nil
+}
+
+func marshalSession(obj interface{}) ([]byte, error) {
+	if obj == nil {
+		return nil, fmt.Errorf("cannotInsertNilObject")
+	}
+	return json.Marshal(obj)
+}
+
+var _ session.SessionRepo = &cacheRepoMock{}
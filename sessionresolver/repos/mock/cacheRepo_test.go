@@ -0,0 +1,24 @@
+package mock_test
+
+import (
+	"github.com/orchestd/cacheStorage"
+	"github.com/orchestd/session"
+	"github.com/orchestd/session/sessionresolver/repos/mock"
+	"github.com/orchestd/session/sessiontest"
+	"testing"
+)
+
+func TestCacheRepoMock(t *testing.T) {
+	sessiontest.RunRepoSuite(t, func(t *testing.T, collections []cacheStorage.CacheVersions) session.SessionRepo {
+		repo := mock.NewCacheRepoMock()
+		for _, collection := range collections {
+			repo.SetCollection(mock.Collection{
+				CollectionName:  collection.CollectionName,
+				CacheType:       collection.CacheType,
+				LockVersionUpon: collection.LockVersionUpon,
+				Versions:        collection.Versions,
+			})
+		}
+		return repo
+	})
+}
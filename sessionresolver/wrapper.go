@@ -2,21 +2,37 @@ package sessionresolver
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/orchestd/session"
 	"github.com/orchestd/session/models"
 	"github.com/orchestd/sharedlib/slices"
 	"github.com/orchestd/tokenauth"
+	"sort"
+	"sync"
 	"time"
 )
 
 type sessionWrapper struct {
-	repo session.SessionRepo
+	repo                session.SessionRepo
+	maxLifetime         time.Duration
+	idleTimeout         time.Duration
+	rotationGracePeriod time.Duration
+	clock               session.Clock
+	fakeNowPolicy       session.FakeNowPolicy
+	fakeNowAuditor      session.FakeNowAuditor
+	versionFallback     models.VersionFallbackPolicy
+	versionPreviewClaim string
+	loads               *loadGroup
 }
 
-const DataVersionsKey = "versions"
-const DataNowKey = "dateNow"
+const maxUpdateAttempts = 5
+
+// idleRefreshDivisor throttles the idle expiry refresh of reads to once every idle timeout divided by it.
+const idleRefreshDivisor = 10
 
 type ActiveOrder struct {
 	Id             string            `json:"id"`
@@ -27,6 +43,81 @@ type ActiveOrder struct {
 	Versions       map[string]string `json:"versions"`
 }
 
+func (ao ActiveOrder) GetId() string {
+	return ao.Id
+}
+
+func (ao ActiveOrder) GetSubServiceType() string {
+	return ao.SubServiceType
+}
+
+func (ao ActiveOrder) GetStoreId() string {
+	return ao.StoreId
+}
+
+func (ao ActiveOrder) GetTimeTo() time.Time {
+	return ao.TimeTo
+}
+
+func (ao ActiveOrder) GetTags() []string {
+	if ao.Tags == nil {
+		return nil
+	}
+	return append([]string(nil), ao.Tags...)
+}
+
+func (ao ActiveOrder) GetVersions() map[string]string {
+	return copyVersions(ao.Versions)
+}
+
+// FreezeScope is a named set of frozen versions, an empty ExpiresAt never expires.
+type FreezeScope struct {
+	Name      string            `json:"name"`
+	Versions  map[string]string `json:"versions"`
+	CreatedAt time.Time         `json:"createdAt"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+}
+
+func (fs FreezeScope) GetName() string {
+	return fs.Name
+}
+
+func (fs FreezeScope) GetVersions() map[string]string {
+	return copyVersions(fs.Versions)
+}
+
+func (fs FreezeScope) GetCreatedAt() time.Time {
+	return fs.CreatedAt
+}
+
+func (fs FreezeScope) GetExpiresAt() time.Time {
+	return fs.ExpiresAt
+}
+
+func (fs FreezeScope) isExpired(now time.Time) bool {
+	return !fs.ExpiresAt.IsZero() && !now.Before(fs.ExpiresAt)
+}
+
+// VersionPreview resolves a session's versions as of AsOf, with Versions overriding single collections.
+// A zero AsOf means the session's own time.
+type VersionPreview struct {
+	AsOf     time.Time         `json:"asOf"`
+	Versions map[string]string `json:"versions"`
+}
+
+// fakeClockState is the stored fake clock of a session, it shifts the real time by Offset
+// and runs it Speed times faster, counting from Anchor.
+type fakeClockState struct {
+	Anchor time.Time
+	Offset time.Duration
+	Speed  float64
+}
+
+func (fc fakeClockState) now(realNow time.Time) time.Time {
+	elapsed := realNow.Sub(fc.Anchor)
+	return fc.Anchor.Add(fc.Offset).Add(time.Duration(float64(elapsed) * fc.Speed))
+}
+
 type Otp struct {
 	UUID string `json:"uuid"`
 }
@@ -54,15 +145,30 @@ type currentSession struct {
 	CustomerId           string
 	ActiveOrderId        string
 	FakeNow              *time.Time
+	FakeClock            *fakeClockState
 	FixedCacheVersions   map[string]string
 	CurrentCacheVersions map[string]string
-	ActiveOrder          *ActiveOrder
+	FreezeScopes         []*FreezeScope
+	VersionPreview       *VersionPreview
+	ActiveOrder          *ActiveOrder // only read from sessions stored before Orders, see migrateActiveOrder
+	Orders               map[string]*ActiveOrder
+	ActiveOrderKey       string
 	OtpData              *Otp
 	CustomerStatus       CustomerStatus
 	Lang                 string
 	Referrer             string
 	DeviceInfo           deviceInfo
 	TermsApproval        bool
+	CreatedAt            time.Time
+	LastAccessAt         time.Time
+	ExpiresAt            time.Time
+	RotatedTo            string
+	Revision             int64
+	TimeZone             string
+
+	clock          session.Clock
+	fakeNowChanged bool
+	dirtyFields    map[string]bool
 }
 
 func (di deviceInfo) GetHardware() string {
@@ -94,44 +200,270 @@ func (di deviceInfo) GetOSVersion() string {
 }
 
 func (c *currentSession) SetCustomerDetails(id string, isNew bool) {
-	c.CustomerId = id
+	status := ExistingCustomer
 	if id == "" {
-		c.CustomerStatus = NoCustomer
+		status = NoCustomer
 	} else if isNew {
-		c.CustomerStatus = NewCustomer
-	} else {
-		c.CustomerStatus = ExistingCustomer
+		status = NewCustomer
+	}
+	if c.CustomerId != id || c.CustomerStatus != status {
+		c.CustomerId = id
+		c.CustomerStatus = status
+		c.markDirty("CustomerId", "CustomerStatus")
 	}
 }
 
 func (c *currentSession) SetOtpData(uuid string) {
-	c.OtpData = &Otp{UUID: uuid}
+	if c.OtpData == nil || c.OtpData.UUID != uuid {
+		c.OtpData = &Otp{UUID: uuid}
+		c.markDirty("OtpData")
+	}
 }
 
+// SetFakeNow freezes the session's time at fakeNow.
 func (c *currentSession) SetFakeNow(fakeNow time.Time) {
 	c.FakeNow = &fakeNow
+	c.FakeClock = nil
+	c.fakeNowChanged = true
+	c.markDirty("FakeNow", "FakeClock")
+}
+
+// SetFakeClock shifts the session's time by offset from now on and lets it advance speed times faster
+// than the real time, a speed that is not positive means the real speed.
+func (c *currentSession) SetFakeClock(offset time.Duration, speed float64) {
+	if speed <= 0 {
+		speed = 1
+	}
+	c.FakeClock = &fakeClockState{Anchor: c.realNow(), Offset: offset, Speed: speed}
+	c.FakeNow = nil
+	c.fakeNowChanged = true
+	c.markDirty("FakeNow", "FakeClock")
+}
+
+func (c *currentSession) ClearFakeNow() {
+	if !c.HasFakeNow() {
+		return
+	}
+	c.FakeNow = nil
+	c.FakeClock = nil
+	c.fakeNowChanged = true
+	c.markDirty("FakeNow", "FakeClock")
+}
+
+// SetVersionPreview makes the session see the versions of asOf and the given versions,
+// without changing its time. It only applies in requests whose token allows previews.
+func (c *currentSession) SetVersionPreview(asOf time.Time, versions map[string]string) {
+	if c.VersionPreview != nil && c.VersionPreview.AsOf.Equal(asOf) && sameVersions(c.VersionPreview.Versions, versions) {
+		return
+	}
+	preview := &VersionPreview{AsOf: asOf, Versions: make(map[string]string)}
+	for collection, version := range versions {
+		preview.Versions[collection] = version
+	}
+	c.VersionPreview = preview
+	c.markDirty("VersionPreview")
+}
+
+func (c *currentSession) ClearVersionPreview() {
+	if c.VersionPreview == nil {
+		return
+	}
+	c.VersionPreview = nil
+	c.markDirty("VersionPreview")
+}
+
+func (c currentSession) HasVersionPreview() bool {
+	return c.VersionPreview != nil
+}
+
+func (c currentSession) GetVersionPreviewAsOf() time.Time {
+	if c.VersionPreview == nil {
+		return time.Time{}
+	}
+	return c.VersionPreview.AsOf
+}
+
+func (c currentSession) GetVersionPreviewVersions() map[string]string {
+	if c.VersionPreview == nil {
+		return nil
+	}
+	return copyVersions(c.VersionPreview.Versions)
 }
 
 func (c *currentSession) SetFixedCacheVersions(versions map[string]string) {
+	if sameVersions(c.FixedCacheVersions, versions) {
+		return
+	}
 	c.FixedCacheVersions = make(map[string]string)
 	for collection, version := range versions {
 		c.FixedCacheVersions[collection] = version
 	}
+	c.markDirty("FixedCacheVersions")
 }
 
 func (c *currentSession) SetCurrentCacheVersions(versions map[string]string) {
+	if sameVersions(c.CurrentCacheVersions, versions) {
+		return
+	}
 	c.CurrentCacheVersions = make(map[string]string)
 	for collection, version := range versions {
 		c.CurrentCacheVersions[collection] = version
 	}
+	c.markDirty("CurrentCacheVersions")
+}
+
+// SetFreezeScope freezes versions under name, on top of the scopes opened before it.
+// Freezing an open scope again replaces its versions and expiry but keeps its place, expired scopes are dropped.
+func (c *currentSession) SetFreezeScope(name string, versions map[string]string, expiresAt time.Time) {
+	now := c.realNow()
+	scopes := make([]*FreezeScope, 0, len(c.FreezeScopes)+1)
+	var scope *FreezeScope
+	for _, s := range c.FreezeScopes {
+		if s.isExpired(now) {
+			continue
+		}
+		if s.Name == name {
+			scope = s
+		}
+		scopes = append(scopes, s)
+	}
+	if scope == nil {
+		scope = &FreezeScope{Name: name, CreatedAt: now}
+		scopes = append(scopes, scope)
+	} else if sameVersions(scope.Versions, versions) && scope.ExpiresAt.Equal(expiresAt) && len(scopes) == len(c.FreezeScopes) {
+		return
+	}
+	scope.Versions = make(map[string]string)
+	for collection, version := range versions {
+		scope.Versions[collection] = version
+	}
+	scope.ExpiresAt = expiresAt
+	c.FreezeScopes = scopes
+	c.markDirty("FreezeScopes")
+}
+
+// GetFreezeScope returns the scope frozen under name, nil if there is none or it expired.
+func (c currentSession) GetFreezeScope(name string) session.FreezeScopeResolver {
+	now := c.realNow()
+	for _, scope := range c.FreezeScopes {
+		if scope.Name == name && !scope.isExpired(now) {
+			return *scope
+		}
+	}
+	return nil
+}
+
+// GetFreezeScopes returns the scopes that did not expire, from the first opened to the last.
+func (c currentSession) GetFreezeScopes() []session.FreezeScopeResolver {
+	now := c.realNow()
+	scopes := []session.FreezeScopeResolver{}
+	for _, scope := range c.FreezeScopes {
+		if !scope.isExpired(now) {
+			scopes = append(scopes, *scope)
+		}
+	}
+	return scopes
+}
+
+// RemoveFreezeScope drops the scope frozen under name and reports whether there was one.
+func (c *currentSession) RemoveFreezeScope(name string) bool {
+	for i, scope := range c.FreezeScopes {
+		if scope.Name == name {
+			c.FreezeScopes = append(c.FreezeScopes[:i:i], c.FreezeScopes[i+1:]...)
+			c.markDirty("FreezeScopes")
+			return true
+		}
+	}
+	return false
+}
+
+// GetEffectiveCacheVersions layers the open freeze scopes over CurrentCacheVersions,
+// with FixedCacheVersions overriding them all. Freezing collections one by one drops them from the scopes,
+// so a scope only overrides CurrentCacheVersions for what it froze after them.
+func (c currentSession) GetEffectiveCacheVersions() map[string]string {
+	versions := make(map[string]string)
+	for collection, version := range c.CurrentCacheVersions {
+		versions[collection] = version
+	}
+	for _, scope := range c.GetFreezeScopes() {
+		for collection, version := range scope.GetVersions() {
+			versions[collection] = version
+		}
+	}
+	for collection, version := range c.FixedCacheVersions {
+		versions[collection] = version
+	}
+	return versions
+}
+
+// IsDirty reports whether the session was changed since it was loaded or last saved.
+func (c currentSession) IsDirty() bool {
+	return len(c.dirtyFields) > 0
+}
+
+func (c *currentSession) markDirty(fields ...string) {
+	if c.dirtyFields == nil {
+		c.dirtyFields = make(map[string]bool)
+	}
+	for _, field := range fields {
+		c.dirtyFields[field] = true
+	}
+}
+
+func (c *currentSession) markClean() {
+	c.dirtyFields = nil
+}
+
+// dirtyFieldValues returns the stored form of the changed fields and of the extra ones.
+func (c currentSession) dirtyFieldValues(extra ...string) (map[string]interface{}, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(b, &stored); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]interface{})
+	for field := range c.dirtyFields {
+		fields[field] = stored[field]
+	}
+	for _, field := range extra {
+		fields[field] = stored[field]
+	}
+	return fields, nil
+}
+
+func sameVersions(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for collection, version := range a {
+		if v, ok := b[collection]; !ok || v != version {
+			return false
+		}
+	}
+	return true
+}
+
+// copyVersions returns a copy callers may change without changing the session, nil stays nil.
+func copyVersions(versions map[string]string) map[string]string {
+	if versions == nil {
+		return nil
+	}
+	result := make(map[string]string, len(versions))
+	for collection, version := range versions {
+		result[collection] = version
+	}
+	return result
 }
 
 func (c currentSession) GetCurrentCacheVersions() map[string]string {
-	return c.CurrentCacheVersions
+	return copyVersions(c.CurrentCacheVersions)
 }
 
 func (c currentSession) GetFixedCacheVersions() map[string]string {
-	return c.FixedCacheVersions
+	return copyVersions(c.FixedCacheVersions)
 }
 
 func (c currentSession) GetOtpData() string {
@@ -155,26 +487,142 @@ func (c currentSession) GetCustomerId() string {
 }
 
 func (c currentSession) HasFakeNow() bool {
-	return c.FakeNow != nil
+	return c.FakeNow != nil || c.FakeClock != nil
 }
 
 func (c currentSession) GetNow() time.Time {
 	if c.FakeNow != nil {
 		return *c.FakeNow
+	} else if c.FakeClock != nil {
+		return c.FakeClock.now(c.realNow())
 	} else {
-		// remove timezone
-		l := "2006-01-02 15:04:05"
-		d, _ := time.Parse(l, time.Now().Format(l))
-		return d
+		return c.realNow()
+	}
+}
+
+// realNow reads the resolver's clock, sessions that were not created by a resolver use the real time.
+func (c currentSession) realNow() time.Time {
+	if c.clock == nil {
+		return time.Now().UTC()
 	}
+	return c.clock.Now().UTC()
+}
+
+// GetLocalNow returns GetNow in the session's time zone, or in UTC when the session has none.
+func (c currentSession) GetLocalNow() time.Time {
+	return c.GetNow().In(c.getLocation())
+}
+
+// SetTimeZone sets the session's IANA time zone, e.g. from the device or the store.
+func (c *currentSession) SetTimeZone(timeZone string) error {
+	if _, err := loadLocation(timeZone); err != nil {
+		return err
+	}
+	if c.TimeZone != timeZone {
+		c.TimeZone = timeZone
+		c.markDirty("TimeZone")
+	}
+	return nil
+}
+
+func (c currentSession) GetTimeZone() string {
+	return c.TimeZone
+}
+
+func (c currentSession) getLocation() *time.Location {
+	if c.TimeZone == "" {
+		return time.UTC
+	}
+	location, err := loadLocation(c.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+var locations sync.Map
+
+// loadLocation caches time.LoadLocation, which reads the time zone database on every call.
+func loadLocation(name string) (*time.Location, error) {
+	if location, ok := locations.Load(name); ok {
+		return location.(*time.Location), nil
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, location)
+	return location, nil
 }
 
 func (c currentSession) GetId() string {
 	return c.Id
 }
 
+func (c currentSession) GetCreatedAt() time.Time {
+	return c.CreatedAt
+}
+
+func (c currentSession) GetLastAccessAt() time.Time {
+	return c.LastAccessAt
+}
+
+func (c currentSession) GetExpiresAt() time.Time {
+	return c.ExpiresAt
+}
+
+func (c currentSession) GetRevision() int64 {
+	return c.Revision
+}
+
+// touch records an access at now and recalculates the expiry,
+// which is the earliest of the absolute lifetime and the idle timeout.
+func (c *currentSession) touch(now time.Time, maxLifetime, idleTimeout time.Duration) {
+	if c.CreatedAt.IsZero() {
+		c.CreatedAt = now
+	}
+	c.LastAccessAt = now
+	c.ExpiresAt = time.Time{}
+	if maxLifetime > 0 {
+		c.ExpiresAt = c.CreatedAt.Add(maxLifetime)
+	}
+	if idleTimeout > 0 {
+		idleExpiresAt := now.Add(idleTimeout)
+		if c.ExpiresAt.IsZero() || idleExpiresAt.Before(c.ExpiresAt) {
+			c.ExpiresAt = idleExpiresAt
+		}
+	}
+}
+
+func (c currentSession) isExpired(now time.Time) bool {
+	return !c.ExpiresAt.IsZero() && !now.Before(c.ExpiresAt)
+}
+
+func (c currentSession) clone() (*currentSession, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	cloned := &currentSession{clock: c.clock}
+	if err := json.Unmarshal(b, cloned); err != nil {
+		return nil, err
+	}
+	return cloned, nil
+}
+
+func newSessionId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
 func (c *currentSession) SetLang(lang string) {
-	c.Lang = lang
+	if c.Lang != lang {
+		c.Lang = lang
+		c.markDirty("Lang")
+	}
 }
 
 func (c currentSession) GetLang() string {
@@ -182,7 +630,10 @@ func (c currentSession) GetLang() string {
 }
 
 func (c *currentSession) SetTermsApproval(termsApproval bool) {
-	c.TermsApproval = termsApproval
+	if c.TermsApproval != termsApproval {
+		c.TermsApproval = termsApproval
+		c.markDirty("TermsApproval")
+	}
 }
 
 func (c currentSession) GetTermsApproval() bool {
@@ -190,7 +641,7 @@ func (c currentSession) GetTermsApproval() bool {
 }
 
 func (c *currentSession) SetDeviceInfo(hardware, runtime, os, deviceModel, browserType, appVersion, osVersion string) {
-	c.DeviceInfo = deviceInfo{
+	info := deviceInfo{
 		Hardware:    hardware,
 		Runtime:     runtime,
 		OS:          os,
@@ -199,6 +650,10 @@ func (c *currentSession) SetDeviceInfo(hardware, runtime, os, deviceModel, brows
 		AppVersion:  appVersion,
 		OSVersion:   osVersion,
 	}
+	if c.DeviceInfo != info {
+		c.DeviceInfo = info
+		c.markDirty("DeviceInfo")
+	}
 }
 
 func (c currentSession) GetDeviceInfo() session.DeviceInfoResolver {
@@ -206,55 +661,541 @@ func (c currentSession) GetDeviceInfo() session.DeviceInfoResolver {
 }
 
 func (c *currentSession) SetReferrer(referrer string) {
-	c.Referrer = referrer
+	if c.Referrer != referrer {
+		c.Referrer = referrer
+		c.markDirty("Referrer")
+	}
 }
 
 func (c currentSession) GetReferrer() string {
 	return c.Referrer
 }
 
+// SetOrder adds or replaces the draft order kept under key, e.g. a store id or a sub service type.
+// Replacing the order drops the versions pinned to it.
+func (c *currentSession) SetOrder(key string, id, subServiceType, storeId string, timeTo time.Time, tags []string) {
+	if c.Orders == nil {
+		c.Orders = make(map[string]*ActiveOrder)
+	}
+	c.Orders[key] = &ActiveOrder{
+		Id:             id,
+		SubServiceType: subServiceType,
+		StoreId:        storeId,
+		TimeTo:         timeTo,
+		Tags:           append([]string(nil), tags...),
+	}
+	if key == c.ActiveOrderKey {
+		c.ActiveOrderId = id
+	}
+	c.markDirty("Orders", "ActiveOrderId")
+}
+
+// SetOrderVersions replaces the versions pinned to the order kept under key, it does nothing if there is no such order.
+func (c *currentSession) SetOrderVersions(key string, versions map[string]string) {
+	order, ok := c.Orders[key]
+	if !ok || sameVersions(order.Versions, versions) {
+		return
+	}
+	order.Versions = make(map[string]string)
+	for collection, version := range versions {
+		order.Versions[collection] = version
+	}
+	c.markDirty("Orders")
+}
+
+func (c currentSession) GetOrder(key string) session.ActiveOrderResolver {
+	order, ok := c.Orders[key]
+	if !ok {
+		return nil
+	}
+	return *order
+}
+
+func (c currentSession) GetOrders() map[string]session.ActiveOrderResolver {
+	orders := make(map[string]session.ActiveOrderResolver)
+	for key, order := range c.Orders {
+		orders[key] = *order
+	}
+	return orders
+}
+
+func (c *currentSession) RemoveOrder(key string) {
+	if _, ok := c.Orders[key]; !ok {
+		return
+	}
+	delete(c.Orders, key)
+	if key == c.ActiveOrderKey {
+		c.ActiveOrderKey = ""
+		c.ActiveOrderId = ""
+	}
+	c.markDirty("Orders", "ActiveOrderKey", "ActiveOrderId")
+}
+
+// SwitchActiveOrder makes the order kept under key the one that drives the session's versions.
+func (c *currentSession) SwitchActiveOrder(key string) error {
+	order, ok := c.Orders[key]
+	if !ok {
+		return fmt.Errorf("order %v not found in session %v", key, c.Id)
+	}
+	if c.ActiveOrderKey != key {
+		c.ActiveOrderKey = key
+		c.ActiveOrderId = order.Id
+		c.markDirty("ActiveOrderKey", "ActiveOrderId")
+	}
+	return nil
+}
+
+func (c currentSession) GetActiveOrderKey() string {
+	return c.ActiveOrderKey
+}
+
+// SetActiveOrder keeps the order under its id and makes it the active order.
+func (c *currentSession) SetActiveOrder(id, subServiceType, storeId string, timeTo time.Time, tags []string) {
+	c.SetOrder(id, id, subServiceType, storeId, timeTo, tags)
+	_ = c.SwitchActiveOrder(id)
+}
+
+// SetActiveOrderVersions replaces the versions pinned to the active order, it does nothing without an active order.
+func (c *currentSession) SetActiveOrderVersions(versions map[string]string) {
+	c.SetOrderVersions(c.ActiveOrderKey, versions)
+}
+
+func (c currentSession) HasActiveOrder() bool {
+	_, ok := c.Orders[c.ActiveOrderKey]
+	return ok
+}
+
+func (c currentSession) GetActiveOrder() session.ActiveOrderResolver {
+	return c.GetOrder(c.ActiveOrderKey)
+}
+
+func (c currentSession) GetActiveOrderId() string {
+	return c.ActiveOrderId
+}
+
+// ClearActiveOrder removes the active order, the other draft orders are kept.
+func (c *currentSession) ClearActiveOrder() {
+	c.RemoveOrder(c.ActiveOrderKey)
+}
+
+// migrateActiveOrder moves a single active order stored before sessions kept several orders into Orders.
+func (c *currentSession) migrateActiveOrder() {
+	if c.ActiveOrder == nil {
+		return
+	}
+	// old sessions may carry the order id only on the session itself
+	key := c.ActiveOrder.Id
+	if key == "" {
+		key = c.ActiveOrderId
+	}
+	if c.ActiveOrder.Id == "" {
+		c.ActiveOrder.Id = key
+	}
+	if _, ok := c.Orders[key]; !ok {
+		if c.Orders == nil {
+			c.Orders = make(map[string]*ActiveOrder)
+		}
+		c.Orders[key] = c.ActiveOrder
+		if c.ActiveOrderKey == "" {
+			c.ActiveOrderKey = key
+		}
+	}
+	if c.ActiveOrderId == "" {
+		c.ActiveOrderId = key
+	}
+	c.ActiveOrder = nil
+	c.markDirty("ActiveOrder", "Orders", "ActiveOrderKey", "ActiveOrderId")
+}
+
 func (sw sessionWrapper) NewSession(id string) session.Session {
-	newCurrentSession := &currentSession{Id: id, CustomerStatus: NoCustomer}
+	newCurrentSession := &currentSession{Id: id, CustomerStatus: NoCustomer, clock: sw.clock}
+	newCurrentSession.markDirty("Id", "CustomerStatus")
+	newCurrentSession.touch(sw.clock.Now(), sw.maxLifetime, sw.idleTimeout)
 	return newCurrentSession
 }
 
-func (sw sessionWrapper) SaveSession(c context.Context, cSession session.Session) error {
-	return sw.repo.InsertOrUpdate(c, cSession.GetId(), cSession)
+// SaveSession stores the session only if nobody else saved it since it was loaded,
+// otherwise it returns a *session.ConflictError.
+// A session that was not changed since it was loaded or saved is not written, SaveSession reports whether it wrote.
+// Conflicts are detected only as far as the repo's CompareAndSwap is atomic, the cache repo's only within one process.
+func (sw sessionWrapper) SaveSession(c context.Context, cSession session.Session) (bool, error) {
+	cs, ok := cSession.(*currentSession)
+	if !ok {
+		err := sw.repo.InsertOrUpdate(c, cSession.GetId(), cSession)
+		return err == nil, err
+	}
+	if !cs.IsDirty() {
+		return false, nil
+	}
+	cs.touch(sw.clock.Now(), sw.maxLifetime, sw.idleTimeout)
+	revision := cs.Revision
+	cs.Revision++
+	swapped, err := sw.repo.CompareAndSwap(c, cs.Id, revision, cs)
+	if err != nil || !swapped {
+		cs.Revision = revision
+	}
+	if err != nil {
+		return false, err
+	}
+	if !swapped {
+		return false, &session.ConflictError{SessionId: cs.Id, Revision: revision}
+	}
+	cs.markClean()
+	if cs.fakeNowChanged {
+		sw.auditFakeNow(c, cs)
+		cs.fakeNowChanged = false
+	}
+	return true, nil
 }
 
-func (sw sessionWrapper) UnFreezeCacheVersionsForSession(c context.Context, curSession session.Session, action string) error {
-	versions := make(map[string]string)
-	currentCacheVersions := curSession.GetCurrentCacheVersions()
+// PatchSession writes only the fields changed since the session was loaded or saved, in a single atomic step.
+// Unlike SaveSession it does not conflict with changes others made to other fields,
+// a session that was never saved is saved whole. It is atomic only as far as the repo's Patch is.
+func (sw sessionWrapper) PatchSession(c context.Context, cSession session.Session) (bool, error) {
+	cs, ok := cSession.(*currentSession)
+	if !ok || cs.Revision == 0 {
+		return sw.SaveSession(c, cSession)
+	}
+	if !cs.IsDirty() {
+		return false, nil
+	}
+	cs.touch(sw.clock.Now(), sw.maxLifetime, sw.idleTimeout)
+	fields, err := cs.dirtyFieldValues("CreatedAt", "LastAccessAt", "ExpiresAt")
+	if err != nil {
+		return false, err
+	}
+	found, revision, err := sw.repo.Patch(c, cs.Id, fields)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		return false, session.ErrSessionNotFound
+	}
+	// the session is only known to match the stored one if nobody else wrote in between
+	if revision == cs.Revision+1 {
+		cs.Revision = revision
+	}
+	cs.markClean()
+	if cs.fakeNowChanged {
+		sw.auditFakeNow(c, cs)
+		cs.fakeNowChanged = false
+	}
+	return true, nil
+}
+
+func (sw sessionWrapper) auditFakeNow(c context.Context, cs *currentSession) {
+	setBy, _ := tokenDataFromContext(c)
+	record := session.FakeNowAuditRecord{
+		SessionId:  cs.Id,
+		CustomerId: cs.CustomerId,
+		SetBy:      setBy,
+		Cleared:    !cs.HasFakeNow(),
+		Allowed:    sw.fakeNowPolicy.IsFakeNowAllowed(c, cs),
+		At:         sw.clock.Now(),
+	}
+	if cs.HasFakeNow() {
+		record.FakeNow = cs.GetNow()
+	}
+	sw.fakeNowAuditor.FakeNowChanged(c, record)
+}
+
+// sessionNow is the session's time, or the real time when the policy does not allow the session's fake time.
+func (sw sessionWrapper) sessionNow(c context.Context, curSession session.Session) time.Time {
+	now, _ := sw.checkedSessionNow(c, curSession)
+	return now
+}
+
+// checkedSessionNow is sessionNow that also tells whether the session's fake time was ignored.
+func (sw sessionWrapper) checkedSessionNow(c context.Context, curSession session.Session) (time.Time, bool) {
+	if curSession.HasFakeNow() && !sw.fakeNowPolicy.IsFakeNowAllowed(c, curSession) {
+		return sw.clock.Now().UTC(), true
+	}
+	return curSession.GetNow(), false
+}
+
+// UpdateSession loads the session, applies update and saves it, starting over when the save conflicts.
+// Like SaveSession it cannot notice conflicting writes the repo does not detect, e.g. from other processes sharing the cache repo.
+func (sw sessionWrapper) UpdateSession(c context.Context, id string, update func(session.Session) error) error {
+	for attempt := 1; ; attempt++ {
+		ok, s, err := sw.loadSession(c, id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return session.ErrSessionNotFound
+		}
+		if err := update(s); err != nil {
+			return err
+		}
+		_, err = sw.SaveSession(c, s)
+		var conflict *session.ConflictError
+		if errors.As(err, &conflict) && attempt < maxUpdateAttempts {
+			continue
+		}
+		return err
+	}
+}
+
+func (sw sessionWrapper) DeleteSession(c context.Context, sessionId string) error {
+	if err := sw.repo.Delete(c, sessionId); err != nil {
+		return err
+	}
+	if memo := memoFromContext(c); memo != nil {
+		memo.forget(sessionId)
+	}
+	return nil
+}
+
+// RevokeSession deletes the session carried in the current token, so that token can no longer be used.
+func (sw sessionWrapper) RevokeSession(c context.Context) error {
+	sessionId, err := sw.GetTokenDataValueAsString(c, "sessionId")
+	if err != nil {
+		return err
+	}
+	return sw.DeleteSession(c, sessionId)
+}
 
+// RotateSession copies the session under a freshly generated id and leaves a tombstone under the old id
+// that resolves to the new session for the rotation grace period.
+// The caller is expected to reissue the token with the returned id.
+func (sw sessionWrapper) RotateSession(c context.Context, curSession session.Session) (string, session.Session, error) {
+	cs, ok := curSession.(*currentSession)
+	if !ok {
+		return "", nil, fmt.Errorf("cannot rotate session of type %T", curSession)
+	}
+	newId, err := newSessionId()
+	if err != nil {
+		return "", nil, err
+	}
+	rotated, err := cs.clone()
+	if err != nil {
+		return "", nil, err
+	}
+	rotated.Id = newId
+	rotated.RotatedTo = ""
+	rotated.Revision = 0
+	rotated.markDirty("Id")
+	if _, err := sw.SaveSession(c, rotated); err != nil {
+		return "", nil, err
+	}
+
+	now := sw.clock.Now()
+	tombstone := &currentSession{
+		Id:           cs.Id,
+		CreatedAt:    cs.CreatedAt,
+		LastAccessAt: now,
+		ExpiresAt:    now.Add(sw.rotationGracePeriod),
+		RotatedTo:    newId,
+		Revision:     cs.Revision + 1,
+	}
+	swapped, err := sw.repo.CompareAndSwap(c, tombstone.Id, cs.Revision, tombstone)
+	if err == nil && !swapped {
+		err = &session.ConflictError{SessionId: cs.Id, Revision: cs.Revision}
+	}
+	if err != nil {
+		_ = sw.repo.Delete(c, newId)
+		return "", nil, err
+	}
+	if memo := memoFromContext(c); memo != nil && memo.get() == curSession {
+		memo.set(rotated)
+	}
+	return newId, rotated, nil
+}
+
+// UnFreezeCacheVersionsForSession drops the freeze scope of action together with the versions of the collections
+// locked upon action that CurrentCacheVersions holds, as sessions frozen before freezes were kept in scopes do.
+// The versions other actions froze in their scopes stay in place.
+// An empty action keeps every frozen version, as it always did.
+func (sw sessionWrapper) UnFreezeCacheVersionsForSession(c context.Context, curSession session.Session, action string) error {
+	if action == "" {
+		return nil
+	}
 	collectionsAfterFilter, err := sw.repo.GetCollectionsFilterActions(c, action)
 	if err != nil {
 		return err
 	}
+	removed := curSession.RemoveFreezeScope(action)
+	if len(dropCurrentCacheVersions(curSession, collectionsAfterFilter)) == 0 && !removed {
+		return nil
+	}
+	_, err = sw.SaveSession(c, curSession)
+	return err
+}
 
-	for k, v := range currentCacheVersions {
-		if action == "" || !slices.IsStrExist(collectionsAfterFilter, action) {
-			versions[k] = v
+// FreezeCacheVersionsForCollections pins the versions of the session's date for the given collections only,
+// with the session's fixed versions overriding them. It returns the collections whose frozen version changed.
+// The versions are kept in CurrentCacheVersions and the collections are dropped from the open freeze scopes,
+// which would otherwise override them, so the latest freeze of a collection always wins.
+func (sw sessionWrapper) FreezeCacheVersionsForCollections(c context.Context, curSession session.Session, collections []string) ([]string, error) {
+	versionsForDate, err := sw.freezeVersions(c, curSession, nil, "", "")
+	if err != nil {
+		return nil, err
+	}
+	frozen := curSession.GetEffectiveCacheVersions()
+	versions := make(map[string]string)
+	for collection, ver := range curSession.GetCurrentCacheVersions() {
+		versions[collection] = ver
+	}
+	changed := []string{}
+	for _, collection := range collections {
+		ver, ok := versionsForDate[collection]
+		if !ok {
+			return nil, fmt.Errorf("collection %v not found", collection)
 		}
+		if cur, ok := frozen[collection]; !ok || cur != ver {
+			changed = append(changed, collection)
+		}
+		versions[collection] = ver
+	}
+	dropped := dropFreezeScopesVersions(curSession, collections)
+	if len(changed) == 0 && len(dropped) == 0 && sameVersions(versions, curSession.GetCurrentCacheVersions()) {
+		return changed, nil
 	}
 	curSession.SetCurrentCacheVersions(versions)
-	err = sw.SaveSession(c, curSession)
+	if _, err := sw.SaveSession(c, curSession); err != nil {
+		return nil, err
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// UnFreezeCacheVersionsForCollections drops the session's frozen versions of the given collections,
+// from CurrentCacheVersions and from every open freeze scope. It returns the collections that were frozen.
+func (sw sessionWrapper) UnFreezeCacheVersionsForCollections(c context.Context, curSession session.Session, collections []string) ([]string, error) {
+	changed := dropCurrentCacheVersions(curSession, collections)
+	for _, collection := range dropFreezeScopesVersions(curSession, collections) {
+		if !slices.IsStrExist(changed, collection) {
+			changed = append(changed, collection)
+		}
+	}
+	if len(changed) == 0 {
+		return changed, nil
+	}
+	if _, err := sw.SaveSession(c, curSession); err != nil {
+		return nil, err
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// dropCurrentCacheVersions removes the given collections from the session's CurrentCacheVersions
+// and returns those it held.
+func dropCurrentCacheVersions(curSession session.Session, collections []string) []string {
+	versions := make(map[string]string)
+	dropped := []string{}
+	for k, v := range curSession.GetCurrentCacheVersions() {
+		if slices.IsStrExist(collections, k) {
+			dropped = append(dropped, k)
+			continue
+		}
+		versions[k] = v
+	}
+	if len(dropped) > 0 {
+		curSession.SetCurrentCacheVersions(versions)
+	}
+	return dropped
+}
+
+// dropFreezeScopesVersions removes the given collections from every open freeze scope of the session,
+// keeping the scopes themselves, and returns the collections any of them held.
+func dropFreezeScopesVersions(curSession session.Session, collections []string) []string {
+	dropped := []string{}
+	for _, scope := range curSession.GetFreezeScopes() {
+		versions := make(map[string]string)
+		scopeDropped := false
+		for k, v := range scope.GetVersions() {
+			if slices.IsStrExist(collections, k) {
+				scopeDropped = true
+				if !slices.IsStrExist(dropped, k) {
+					dropped = append(dropped, k)
+				}
+				continue
+			}
+			versions[k] = v
+		}
+		if scopeDropped {
+			curSession.SetFreezeScope(scope.GetName(), versions, scope.GetExpiresAt())
+		}
+	}
+	return dropped
+}
+
+// FreezeCacheVersionsForSession freezes the versions of the session's date for the collections locked upon action
+// into the freeze scope named after action, see FreezeCacheVersionsForScope.
+func (sw sessionWrapper) FreezeCacheVersionsForSession(c context.Context, curSession session.Session, action string, cacheType string) error {
+	return sw.FreezeCacheVersionsForScope(c, curSession, action, action, cacheType, 0)
+}
+
+// FreezeCacheVersionsForScope freezes the versions of the session's date for the collections locked upon action
+// into the scope named scope, adding to the versions the scope already froze. The scope expires after ttl unless ttl is 0.
+func (sw sessionWrapper) FreezeCacheVersionsForScope(c context.Context, curSession session.Session, scope string, action string, cacheType string, ttl time.Duration) error {
+	versionsForDate, _, err := sw.repo.GetCacheVersionsWithFallback(c, sw.sessionNow(c, curSession), action, cacheType, sw.versionFallback)
+	if err != nil {
+		return err
+	}
+	versions := make(map[string]string)
+	if open := curSession.GetFreezeScope(scope); open != nil {
+		versions = open.GetVersions()
+	}
+	for collection, ver := range versionsForDate {
+		versions[collection] = ver
+	}
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = sw.clock.Now().Add(ttl)
+	}
+	curSession.SetFreezeScope(scope, versions, expiresAt)
+	_, err = sw.SaveSession(c, curSession)
+	return err
+}
+
+// UnFreezeCacheVersionsForScope drops the scope named scope, leaving the versions frozen by other scopes in place.
+func (sw sessionWrapper) UnFreezeCacheVersionsForScope(c context.Context, curSession session.Session, scope string) error {
+	if !curSession.RemoveFreezeScope(scope) {
+		return nil
+	}
+	_, err := sw.SaveSession(c, curSession)
+	return err
+}
+
+// FreezeCacheVersionsForActiveOrder pins versions into the active order,
+// so the order keeps the versions it was started with for as long as it is active.
+func (sw sessionWrapper) FreezeCacheVersionsForActiveOrder(c context.Context, curSession session.Session, action string, cacheType string) error {
+	if !curSession.HasActiveOrder() {
+		return fmt.Errorf("session %v has no active order", curSession.GetId())
+	}
+	return sw.FreezeCacheVersionsForOrder(c, curSession, curSession.GetActiveOrderKey(), action, cacheType)
+}
+
+// FreezeCacheVersionsForOrder pins versions into the draft order kept under key.
+func (sw sessionWrapper) FreezeCacheVersionsForOrder(c context.Context, curSession session.Session, key string, action string, cacheType string) error {
+	order := curSession.GetOrder(key)
+	if order == nil {
+		return fmt.Errorf("order %v not found in session %v", key, curSession.GetId())
+	}
+	versions, err := sw.freezeVersions(c, curSession, order.GetVersions(), action, cacheType)
+	if err != nil {
+		return err
+	}
+	curSession.SetOrderVersions(key, versions)
+	_, err = sw.SaveSession(c, curSession)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (sw sessionWrapper) FreezeCacheVersionsForSession(c context.Context, curSession session.Session, action string, cacheType string) error {
+// freezeVersions merges the versions of the session's date into frozen,
+// with the session's fixed versions overriding both.
+func (sw sessionWrapper) freezeVersions(c context.Context, curSession session.Session, frozen map[string]string, action string, cacheType string) (map[string]string, error) {
 	versions := make(map[string]string)
-
-	currentCacheVersions := curSession.GetCurrentCacheVersions()
-	for collection, ver := range currentCacheVersions {
+	for collection, ver := range frozen {
 		versions[collection] = ver
 	}
 
-	versionsForDate, err := sw.repo.GetCacheVersions(c, curSession.GetNow(), action, cacheType)
+	versionsForDate, _, err := sw.repo.GetCacheVersionsWithFallback(c, sw.sessionNow(c, curSession), action, cacheType, sw.versionFallback)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	for collection, ver := range versionsForDate {
 		versions[collection] = ver
@@ -264,33 +1205,87 @@ func (sw sessionWrapper) FreezeCacheVersionsForSession(c context.Context, curSes
 	for collection, ver := range fixedVersions {
 		versions[collection] = ver
 	}
+	return versions, nil
+}
 
-	curSession.SetCurrentCacheVersions(versions)
-	err = sw.SaveSession(c, curSession)
-	if err != nil {
-		return err
+// loadSession reads a session from the repo, sharing a single read between concurrent loads of the same id.
+// The shared read runs with the context of the first caller, callers whose context outlives its cancellation read again.
+func (sw sessionWrapper) loadSession(c context.Context, id string) (bool, *currentSession, error) {
+	return sw.loads.do(c, id, func(c context.Context) (bool, *currentSession, error) {
+		return sw.readSession(c, id)
+	})
+}
+
+// readSession reads a session from the repo, treating expired sessions as not found,
+// following rotation tombstones to the new session
+// and sliding the idle expiry forward at most once every tenth of the idle timeout.
+func (sw sessionWrapper) readSession(c context.Context, id string) (bool, *currentSession, error) {
+	s := &currentSession{clock: sw.clock}
+	if ok, err := sw.repo.GetUserSessionByTokenToStruct(c, id, s); err != nil || !ok {
+		return false, nil, err
 	}
-	return nil
+	s.migrateActiveOrder()
+	now := sw.clock.Now()
+	if s.isExpired(now) {
+		return false, nil, nil
+	}
+	if s.RotatedTo != "" {
+		return sw.readSession(c, s.RotatedTo)
+	}
+	if sw.idleTimeout > 0 && now.Sub(s.LastAccessAt) >= sw.idleTimeout/idleRefreshDivisor {
+		// only the expiry is written and the revision is kept, so the refresh neither overwrites
+		// what another instance saved meanwhile nor makes sessions loaded in parallel conflict
+		s.touch(now, sw.maxLifetime, sw.idleTimeout)
+		found, err := sw.repo.Touch(c, id, map[string]interface{}{
+			"CreatedAt":    s.CreatedAt,
+			"LastAccessAt": s.LastAccessAt,
+			"ExpiresAt":    s.ExpiresAt,
+		})
+		if err != nil || !found {
+			return false, nil, err
+		}
+	}
+	return true, s, nil
 }
 
 func (sw sessionWrapper) GetSessionById(c context.Context, id string) (bool, session.Session, error) {
-	s := currentSession{}
-	ok, err := sw.repo.GetUserSessionByTokenToStruct(c, id, &s)
-	return ok, &s, err
+	ok, s, err := sw.loadSession(c, id)
+	if err != nil || !ok {
+		return false, nil, err
+	}
+	return true, s, nil
 }
 
+// GetCurrentSession returns the session carried in the token,
+// reusing the session already loaded for the request when the context has one, see WithSessionMemo.
 func (s *sessionWrapper) GetCurrentSession(c context.Context) (session.Session, error) {
-	var currentSession currentSession
+	if cSession, ok := SessionFromContext(c); ok {
+		return cSession, nil
+	}
+	return s.ReloadCurrentSession(c)
+}
+
+// ReloadCurrentSession reads the session carried in the token from the repo, even if the request already loaded it.
+func (s *sessionWrapper) ReloadCurrentSession(c context.Context) (session.Session, error) {
 	if sessionId, err := s.GetTokenDataValueAsString(c, "sessionId"); err != nil {
 		return nil, err
-	} else if _, err := s.repo.GetUserSessionByTokenToStruct(c, sessionId, &currentSession); err != nil {
+	} else if ok, currentSession, err := s.loadSession(c, sessionId); err != nil {
 		return nil, err
+	} else if !ok {
+		return nil, session.ErrSessionNotFound
 	} else {
-		return &currentSession, nil
+		if memo := memoFromContext(c); memo != nil {
+			memo.set(currentSession)
+		}
+		return currentSession, nil
 	}
 }
 
 func (s *sessionWrapper) GetTokenData(c context.Context) (map[string]interface{}, error) {
+	return tokenDataFromContext(c)
+}
+
+func tokenDataFromContext(c context.Context) (map[string]interface{}, error) {
 	tokenData := make(map[string]interface{})
 	if tokenDataJson, ok := c.Value(tokenauth.TokenDataContextKey).(string); !ok {
 		return nil, fmt.Errorf("tokenDataNotFound")
@@ -317,14 +1312,20 @@ func (s *sessionWrapper) GetTokenDataValueAsString(c context.Context, key string
 }
 
 func (s sessionWrapper) SetDataFromCurrentSessionToContext(c context.Context, curSession session.Session) (context.Context, error) {
-	c, err := s.versionsToContext(c, curSession)
+	now, ignored := s.checkedSessionNow(c, curSession)
+	if ignored {
+		// reported here only, once per request, not on every read of the session's time
+		s.fakeNowAuditor.FakeNowIgnored(c, curSession)
+	}
+	c, err := s.versionsToContext(c, curSession, now)
 	if err != nil {
 		return c, err
 	}
 
-	c, err = s.nowToContext(c, curSession)
-	if err != nil {
-		return c, err
+	c = s.nowToContext(c, now)
+	// only the session of the token is the request's current session, e.g. not a customer's one an admin acts on
+	if sessionId, err := s.GetTokenDataValueAsString(c, "sessionId"); err == nil && sessionId == curSession.GetId() {
+		c = contextWithSession(c, curSession)
 	}
 	return c, nil
 }
@@ -339,51 +1340,82 @@ func (s sessionWrapper) SetDataToContext(c context.Context, curSession session.S
 	return s.SetDataFromCurrentSessionToContext(c, curSession)
 }
 
-func (s sessionWrapper) nowToContext(c context.Context, curSession session.Session) (context.Context, error) {
-	now := curSession.GetNow()
-	b, err := json.Marshal(now)
-	if err != nil {
-		return nil, err
+// GetNowFromContext returns the time of the request's session, including a fake now the policy allows,
+// falling back to the real time when SetDataToContext was not called.
+func (s sessionWrapper) GetNowFromContext(c context.Context) time.Time {
+	if now, ok := NowFromContext(c); ok {
+		return now
 	}
-	c = context.WithValue(c, DataNowKey, string(b))
-	return c, nil
+	if curSession, ok := SessionFromContext(c); ok {
+		return s.sessionNow(c, curSession)
+	}
+	return s.clock.Now()
 }
 
-func (s sessionWrapper) versionsToContext(c context.Context, curSession session.Session) (context.Context, error) {
-	versions := curSession.GetCurrentCacheVersions()
+// GetVersionFallbacksFromContext returns the collections whose version for the request fell back
+// because they had none for the session's date, so they can be logged.
+func (s sessionWrapper) GetVersionFallbacksFromContext(c context.Context) []string {
+	fellBack, _ := VersionFallbacksFromContext(c)
+	return fellBack
+}
+
+func (s sessionWrapper) nowToContext(c context.Context, now time.Time) context.Context {
+	return contextWithNow(c, now)
+}
 
-	versionsForDate, err := s.repo.GetCacheVersions(c, curSession.GetNow(), "", "")
+// versionsToContext resolves the versions of now, overridden in turn by the session's frozen versions,
+// by the versions pinned to its active order and by its fixed versions, so fixed versions always win.
+// An allowed version preview replaces all of them with the versions of its own time and its explicit versions.
+func (s sessionWrapper) versionsToContext(c context.Context, curSession session.Session, now time.Time) (context.Context, error) {
+	preview := s.isVersionPreviewAllowed(c, curSession)
+	if preview && !curSession.GetVersionPreviewAsOf().IsZero() {
+		now = curSession.GetVersionPreviewAsOf()
+	}
+	versionsForDate, fellBack, err := s.repo.GetCacheVersionsWithFallback(c, now, "", "", s.versionFallback)
 	if err != nil {
 		return nil, err
 	}
+	sort.Strings(fellBack)
+	c = contextWithVersionFallbacks(c, fellBack)
 
-	for k, v := range versionsForDate {
-		if _, ok := versions[k]; !ok {
+	// the repo's map is copied, it may be nil or shared
+	versions := make(models.Versions)
+	layers := []map[string]string{versionsForDate}
+	if preview {
+		layers = append(layers, curSession.GetVersionPreviewVersions())
+	} else {
+		layers = append(layers, curSession.GetEffectiveCacheVersions())
+		if curSession.HasActiveOrder() {
+			layers = append(layers, curSession.GetActiveOrder().GetVersions())
+		}
+		layers = append(layers, curSession.GetFixedCacheVersions())
+	}
+	for _, layer := range layers {
+		for k, v := range layer {
 			versions[k] = v
 		}
 	}
 
-	b, err := json.Marshal(versions)
-	if err != nil {
-		return nil, err
-	}
-	c = context.WithValue(c, DataVersionsKey, string(b))
+	c = contextWithVersions(c, versions)
 	return c, nil
 }
 
-func (s sessionWrapper) GetVersionsFromContext(c context.Context) (models.Versions, bool, error) {
-	v := c.Value(DataVersionsKey)
-	if v == nil {
-		return nil, false, nil
+// isVersionPreviewAllowed reports whether the session has a preview and the request's token carries the preview claim set to true.
+func (s sessionWrapper) isVersionPreviewAllowed(c context.Context, curSession session.Session) bool {
+	if !curSession.HasVersionPreview() || s.versionPreviewClaim == "" {
+		return false
 	}
-
-	versions := make(models.Versions)
-	err := json.Unmarshal([]byte(v.(string)), &versions)
+	tokenData, err := tokenDataFromContext(c)
 	if err != nil {
-		return nil, false, err
+		return false
 	}
+	allowed, _ := tokenData[s.versionPreviewClaim].(bool)
+	return allowed
+}
 
-	return versions, true, nil
+func (s sessionWrapper) GetVersionsFromContext(c context.Context) (models.Versions, bool, error) {
+	versions, ok := VersionsFromContext(c)
+	return versions, ok, nil
 }
 
 func (s sessionWrapper) GetVersionForCollectionFromContext(c context.Context, collectionName string) (string, error) {
@@ -398,6 +1430,62 @@ func (s sessionWrapper) GetVersionForCollectionFromContext(c context.Context, co
 	return ver, nil
 }
 
+// GetVersionsStaleness compares every version in the session's effective versions
+// to the latest version of the session's date, ordered by collection name.
+func (s sessionWrapper) GetVersionsStaleness(c context.Context, curSession session.Session) ([]session.VersionStaleness, error) {
+	now := s.sessionNow(c, curSession)
+	latest, _, err := s.repo.GetCacheVersionsWithFallback(c, now, "", "", models.VersionFallbackPolicy{Default: models.SkipCollection})
+	if err != nil {
+		return nil, err
+	}
+	history, err := s.repo.GetVersionsHistory(c)
+	if err != nil {
+		return nil, err
+	}
+
+	frozen := curSession.GetEffectiveCacheVersions()
+	collections := make([]string, 0, len(frozen))
+	for collection := range frozen {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+
+	result := make([]session.VersionStaleness, 0, len(collections))
+	for _, collection := range collections {
+		staleness := session.VersionStaleness{
+			CollectionName: collection,
+			FrozenVersion:  frozen[collection],
+			LatestVersion:  latest[collection],
+			VersionsBehind: -1,
+		}
+		frozenAt, latestAt := versionIndex(history[collection], staleness.FrozenVersion), versionIndex(history[collection], staleness.LatestVersion)
+		if latestAt >= 0 {
+			staleness.LatestActiveFor = now.Sub(history[collection][latestAt].TimedTo)
+			if frozenAt >= 0 {
+				staleness.VersionsBehind = latestAt - frozenAt
+				if staleness.VersionsBehind < 0 {
+					staleness.VersionsBehind = 0
+				}
+			}
+		}
+		result = append(result, staleness)
+	}
+	return result, nil
+}
+
+// versionIndex returns the index of the last entry of version in history, -1 if there is none.
+func versionIndex(history []models.TimedVersion, version string) int {
+	if version == "" {
+		return -1
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Version == version {
+			return i
+		}
+	}
+	return -1
+}
+
 func (s sessionWrapper) IsObsolete(c context.Context, sessionId string) (bool, error) {
 	ok, _, err := s.GetSessionById(c, sessionId)
 	return !ok, err
@@ -0,0 +1,339 @@
+package sessionresolver_test
+
+import (
+	"context"
+	"errors"
+	"github.com/orchestd/cacheStorage"
+	"github.com/orchestd/session"
+	"github.com/orchestd/session/sessionresolver"
+	"github.com/orchestd/session/sessionresolver/repos/mock"
+	"github.com/orchestd/session/sessiontest"
+	"github.com/orchestd/tokenauth"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func buildResolver(t *testing.T, builder session.SessionResolverBuilder) session.SessionResolver {
+	resolver, err := builder.Build()
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	return resolver
+}
+
+func saveSession(t *testing.T, resolver session.SessionResolver, s session.Session) {
+	if _, err := resolver.SaveSession(context.Background(), s); err != nil {
+		t.Fatalf("save of session %v failed: %v", s.GetId(), err)
+	}
+}
+
+func loadSession(t *testing.T, resolver session.SessionResolver, id string) session.Session {
+	found, s, err := resolver.GetSessionById(context.Background(), id)
+	if err != nil || !found {
+		t.Fatalf("load of session %v returned found %v error %v", id, found, err)
+	}
+	return s
+}
+
+func assertEffectiveVersions(t *testing.T, s session.Session, expected map[string]string) {
+	if versions := s.GetEffectiveCacheVersions(); !reflect.DeepEqual(versions, expected) {
+		t.Fatalf("effective versions are %v, expected %v", versions, expected)
+	}
+}
+
+func menuCollection() mock.Collection {
+	return mock.Collection{
+		CollectionName:  "menu",
+		LockVersionUpon: []string{"checkout"},
+		Versions:        []cacheStorage.Version{{Version: "menu-1", TimedTo: testNow.Add(-time.Hour)}},
+	}
+}
+
+func TestUnFreezeCacheVersionsForSession(t *testing.T) {
+	c := context.Background()
+	repo := mock.NewCacheRepoMock(
+		menuCollection(),
+		mock.Collection{
+			CollectionName:  "banners",
+			LockVersionUpon: []string{"browse"},
+			Versions:        []cacheStorage.Version{{Version: "banners-1", TimedTo: testNow.Add(-time.Hour)}},
+		},
+	)
+	resolver := buildResolver(t, sessionresolver.Builder().SetRepo(repo).SetClock(sessiontest.NewFakeClock(testNow)))
+
+	// frozen before freezes were kept in scopes, then frozen again for the same action
+	s := resolver.NewSession("s1")
+	s.SetCurrentCacheVersions(map[string]string{"menu": "menu-0", "banners": "banners-0"})
+	saveSession(t, resolver, s)
+	if err := resolver.FreezeCacheVersionsForSession(c, s, "checkout", ""); err != nil {
+		t.Fatalf("freeze failed: %v", err)
+	}
+	assertEffectiveVersions(t, s, map[string]string{"menu": "menu-1", "banners": "banners-0"})
+
+	if err := resolver.UnFreezeCacheVersionsForSession(c, s, "checkout"); err != nil {
+		t.Fatalf("unfreeze failed: %v", err)
+	}
+	assertEffectiveVersions(t, s, map[string]string{"banners": "banners-0"})
+	assertEffectiveVersions(t, loadSession(t, resolver, "s1"), map[string]string{"banners": "banners-0"})
+}
+
+func TestUnFreezeCacheVersionsForCollections(t *testing.T) {
+	c := context.Background()
+	repo := mock.NewCacheRepoMock(menuCollection())
+	resolver := buildResolver(t, sessionresolver.Builder().SetRepo(repo).SetClock(sessiontest.NewFakeClock(testNow)))
+
+	s := resolver.NewSession("s1")
+	if err := resolver.FreezeCacheVersionsForSession(c, s, "checkout", ""); err != nil {
+		t.Fatalf("freeze failed: %v", err)
+	}
+	unfrozen, err := resolver.UnFreezeCacheVersionsForCollections(c, s, []string{"menu"})
+	if err != nil || !reflect.DeepEqual(unfrozen, []string{"menu"}) {
+		t.Fatalf("unfreeze returned %v error %v, expected [menu]", unfrozen, err)
+	}
+	assertEffectiveVersions(t, s, map[string]string{})
+
+	// a collection frozen on its own is not overridden by what a scope froze before
+	if err := resolver.FreezeCacheVersionsForSession(c, s, "checkout", ""); err != nil {
+		t.Fatalf("freeze failed: %v", err)
+	}
+	if err := repo.AddVersion("menu", "menu-2", testNow.Add(-time.Minute)); err != nil {
+		t.Fatalf("add version failed: %v", err)
+	}
+	frozen, err := resolver.FreezeCacheVersionsForCollections(c, s, []string{"menu"})
+	if err != nil || !reflect.DeepEqual(frozen, []string{"menu"}) {
+		t.Fatalf("freeze returned %v error %v, expected [menu]", frozen, err)
+	}
+	assertEffectiveVersions(t, s, map[string]string{"menu": "menu-2"})
+	if _, err := resolver.FreezeCacheVersionsForCollections(c, s, []string{"missing"}); err == nil {
+		t.Fatal("freeze of a missing collection did not fail")
+	}
+}
+
+func TestFreezeScopes(t *testing.T) {
+	c := context.Background()
+	clock := sessiontest.NewFakeClock(testNow)
+	repo := mock.NewCacheRepoMock(mock.Collection{
+		CollectionName:  "menu",
+		LockVersionUpon: []string{"checkout", "browse"},
+		Versions:        []cacheStorage.Version{{Version: "menu-1", TimedTo: testNow.Add(-time.Hour)}},
+	})
+	resolver := buildResolver(t, sessionresolver.Builder().SetRepo(repo).SetClock(clock))
+
+	s := resolver.NewSession("s1")
+	if err := resolver.FreezeCacheVersionsForScope(c, s, "browse", "browse", "", 0); err != nil {
+		t.Fatalf("freeze failed: %v", err)
+	}
+	if err := repo.AddVersion("menu", "menu-2", testNow.Add(-time.Minute)); err != nil {
+		t.Fatalf("add version failed: %v", err)
+	}
+	if err := resolver.FreezeCacheVersionsForScope(c, s, "checkout", "checkout", "", time.Minute); err != nil {
+		t.Fatalf("freeze failed: %v", err)
+	}
+	assertEffectiveVersions(t, s, map[string]string{"menu": "menu-2"})
+
+	clock.Advance(2 * time.Minute)
+	assertEffectiveVersions(t, s, map[string]string{"menu": "menu-1"})
+
+	if err := resolver.UnFreezeCacheVersionsForSession(c, s, "browse"); err != nil {
+		t.Fatalf("unfreeze failed: %v", err)
+	}
+	assertEffectiveVersions(t, s, map[string]string{})
+}
+
+func TestSessionExpiry(t *testing.T) {
+	c := context.Background()
+	clock := sessiontest.NewFakeClock(testNow)
+	repo := mock.NewCacheRepoMock()
+	resolver := buildResolver(t, sessionresolver.Builder().SetRepo(repo).SetClock(clock).
+		SetIdleTimeout(time.Hour).SetMaxLifetime(90*time.Minute))
+
+	saveSession(t, resolver, resolver.NewSession("s1"))
+	saveSession(t, resolver, resolver.NewSession("idle"))
+	loadedBefore := loadSession(t, resolver, "s1")
+
+	clock.Advance(30 * time.Minute)
+	refreshed := loadSession(t, resolver, "s1")
+	if refreshed.GetRevision() != 1 {
+		t.Fatalf("idle refresh moved the revision to %v", refreshed.GetRevision())
+	}
+	if !refreshed.GetExpiresAt().Equal(testNow.Add(90 * time.Minute)) {
+		t.Fatalf("session expires at %v, expected the max lifetime to cap it", refreshed.GetExpiresAt())
+	}
+	loadedBefore.SetLang("en")
+	if _, err := resolver.SaveSession(c, loadedBefore); err != nil {
+		t.Fatalf("idle refresh made a session loaded before it conflict: %v", err)
+	}
+
+	clock.Advance(45 * time.Minute)
+	if found, _, err := resolver.GetSessionById(c, "idle"); err != nil || found {
+		t.Fatalf("idle session returned found %v error %v", found, err)
+	}
+	loadSession(t, resolver, "s1")
+
+	clock.Advance(15 * time.Minute)
+	if found, _, err := resolver.GetSessionById(c, "s1"); err != nil || found {
+		t.Fatalf("session past its max lifetime returned found %v error %v", found, err)
+	}
+}
+
+func TestRotateSession(t *testing.T) {
+	c := context.Background()
+	clock := sessiontest.NewFakeClock(testNow)
+	repo := mock.NewCacheRepoMock()
+	resolver := buildResolver(t, sessionresolver.Builder().SetRepo(repo).SetClock(clock).SetRotationGracePeriod(time.Minute))
+
+	s := resolver.NewSession("old")
+	s.SetLang("en")
+	saveSession(t, resolver, s)
+	newId, rotated, err := resolver.RotateSession(c, s)
+	if err != nil {
+		t.Fatalf("rotate failed: %v", err)
+	}
+	if newId == "old" || rotated.GetId() != newId || rotated.GetLang() != "en" {
+		t.Fatalf("rotated session is %v with lang %v, new id %v", rotated.GetId(), rotated.GetLang(), newId)
+	}
+	if followed := loadSession(t, resolver, "old"); followed.GetId() != newId {
+		t.Fatalf("tombstone resolved to %v, expected %v", followed.GetId(), newId)
+	}
+	s.SetLang("de")
+	var conflict *session.ConflictError
+	if _, err := resolver.SaveSession(c, s); !errors.As(err, &conflict) {
+		t.Fatalf("save over the tombstone returned %v, expected a conflict", err)
+	}
+
+	clock.Advance(2 * time.Minute)
+	if found, _, err := resolver.GetSessionById(c, "old"); err != nil || found {
+		t.Fatalf("tombstone past its grace period returned found %v error %v", found, err)
+	}
+	loadSession(t, resolver, newId)
+}
+
+func TestSaveSessionConflict(t *testing.T) {
+	c := context.Background()
+	resolver := buildResolver(t, sessionresolver.Builder().SetRepo(mock.NewCacheRepoMock()).SetClock(sessiontest.NewFakeClock(testNow)))
+	saveSession(t, resolver, resolver.NewSession("s1"))
+
+	first := loadSession(t, resolver, "s1")
+	second := loadSession(t, resolver, "s1")
+	first.SetLang("en")
+	saveSession(t, resolver, first)
+	second.SetLang("de")
+	_, err := resolver.SaveSession(c, second)
+	var conflict *session.ConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("save of a stale session returned %v, expected a conflict", err)
+	}
+	if second.GetRevision() != 1 {
+		t.Fatalf("conflicting save moved the revision to %v", second.GetRevision())
+	}
+	if lang := loadSession(t, resolver, "s1").GetLang(); lang != "en" {
+		t.Fatalf("stored lang is %v, expected en", lang)
+	}
+}
+
+func TestUpdateSession(t *testing.T) {
+	c := context.Background()
+	resolver := buildResolver(t, sessionresolver.Builder().SetRepo(mock.NewCacheRepoMock()).SetClock(sessiontest.NewFakeClock(testNow)))
+	saveSession(t, resolver, resolver.NewSession("s1"))
+
+	attempts := 0
+	err := resolver.UpdateSession(c, "s1", func(s session.Session) error {
+		attempts++
+		if attempts == 1 {
+			other := loadSession(t, resolver, "s1")
+			other.SetLang("en")
+			saveSession(t, resolver, other)
+		}
+		s.SetReferrer("mail")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("update ran %v times, expected a single retry", attempts)
+	}
+	stored := loadSession(t, resolver, "s1")
+	if stored.GetLang() != "en" || stored.GetReferrer() != "mail" {
+		t.Fatalf("stored lang %v and referrer %v, expected both changes", stored.GetLang(), stored.GetReferrer())
+	}
+
+	if err := resolver.UpdateSession(c, "missing", func(session.Session) error { return nil }); err != session.ErrSessionNotFound {
+		t.Fatalf("update of a missing session returned %v", err)
+	}
+}
+
+func TestGetVersionsStaleness(t *testing.T) {
+	repo := mock.NewCacheRepoMock(mock.Collection{
+		CollectionName: "menu",
+		Versions: []cacheStorage.Version{
+			{Version: "menu-1", TimedTo: testNow.Add(-3 * time.Hour)},
+			{Version: "menu-2", TimedTo: testNow.Add(-2 * time.Hour)},
+			{Version: "menu-3", TimedTo: testNow.Add(-time.Hour)},
+			{Version: "menu-4", TimedTo: testNow.Add(time.Hour)},
+		},
+	})
+	resolver := buildResolver(t, sessionresolver.Builder().SetRepo(repo).SetClock(sessiontest.NewFakeClock(testNow)))
+
+	s := resolver.NewSession("s1")
+	s.SetCurrentCacheVersions(map[string]string{"menu": "menu-1", "removed": "removed-1"})
+	staleness, err := resolver.GetVersionsStaleness(context.Background(), s)
+	if err != nil {
+		t.Fatalf("get versions staleness failed: %v", err)
+	}
+	expected := []session.VersionStaleness{
+		{CollectionName: "menu", FrozenVersion: "menu-1", LatestVersion: "menu-3", VersionsBehind: 2, LatestActiveFor: time.Hour},
+		{CollectionName: "removed", FrozenVersion: "removed-1", VersionsBehind: -1},
+	}
+	if !reflect.DeepEqual(staleness, expected) {
+		t.Fatalf("staleness is %+v, expected %+v", staleness, expected)
+	}
+}
+
+func TestVersionPreview(t *testing.T) {
+	repo := mock.NewCacheRepoMock(
+		mock.Collection{CollectionName: "menu", Versions: []cacheStorage.Version{
+			{Version: "menu-1", TimedTo: testNow.Add(-time.Hour)},
+			{Version: "menu-2", TimedTo: testNow.Add(time.Hour)},
+		}},
+		mock.Collection{CollectionName: "banners", Versions: []cacheStorage.Version{
+			{Version: "banners-1", TimedTo: testNow.Add(-time.Hour)},
+		}},
+	)
+	previewToken := context.WithValue(context.Background(), tokenauth.TokenDataContextKey, `{"versionPreview":true}`)
+
+	tests := []struct {
+		name     string
+		builder  session.SessionResolverBuilder
+		c        context.Context
+		expected map[string]string
+	}{
+		{"without the claim", sessionresolver.Builder(), context.Background(), map[string]string{"menu": "menu-1", "banners": "banners-0"}},
+		{"with the claim", sessionresolver.Builder(), previewToken, map[string]string{"menu": "menu-2", "banners": "banners-9"}},
+		{"previews turned off", sessionresolver.Builder().SetVersionPreviewClaim(""), previewToken, map[string]string{"menu": "menu-1", "banners": "banners-0"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolver := buildResolver(t, test.builder.SetRepo(repo).SetClock(sessiontest.NewFakeClock(testNow)))
+			cur := resolver.NewSession("s1")
+			cur.SetCurrentCacheVersions(map[string]string{"banners": "banners-0"})
+			cur.SetVersionPreview(testNow.Add(2*time.Hour), map[string]string{"banners": "banners-9"})
+			c, err := resolver.SetDataToContext(test.c, cur)
+			if err != nil {
+				t.Fatalf("set data to context failed: %v", err)
+			}
+			versions, _ := sessionresolver.VersionsFromContext(c)
+			for collection, version := range test.expected {
+				if versions[collection] != version {
+					t.Fatalf("versions are %v, expected %v", versions, test.expected)
+				}
+			}
+			if now := resolver.GetNowFromContext(c); !now.Equal(testNow) {
+				t.Fatalf("now is %v, a preview must not move it", now)
+			}
+		})
+	}
+}
@@ -0,0 +1,450 @@
+package sessiontest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/orchestd/cacheStorage"
+	"github.com/orchestd/session"
+	"github.com/orchestd/session/models"
+	"github.com/orchestd/session/sessionresolver"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// RepoFactory returns an empty repo whose cache collections are the given ones.
+// It is called once for every sub test.
+type RepoFactory func(t *testing.T, collections []cacheStorage.CacheVersions) session.SessionRepo
+
+// RunRepoSuite checks that a session.SessionRepo behaves like the repos shipped with this module.
+func RunRepoSuite(t *testing.T, factory RepoFactory) {
+	t.Run("NotFound", func(t *testing.T) { testNotFound(t, factory) })
+	t.Run("InsertOrUpdate", func(t *testing.T) { testInsertOrUpdate(t, factory) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, factory) })
+	t.Run("CompareAndSwap", func(t *testing.T) { testCompareAndSwap(t, factory) })
+	t.Run("Patch", func(t *testing.T) { testPatch(t, factory) })
+	t.Run("Touch", func(t *testing.T) { testTouch(t, factory) })
+	t.Run("ConcurrentCompareAndSwap", func(t *testing.T) { testConcurrentCompareAndSwap(t, factory) })
+	t.Run("ConcurrentInsertOrUpdate", func(t *testing.T) { testConcurrentInsertOrUpdate(t, factory) })
+	t.Run("GetCacheVersions", func(t *testing.T) { testGetCacheVersions(t, factory) })
+	t.Run("GetCacheVersionsNoVersion", func(t *testing.T) { testGetCacheVersionsNoVersion(t, factory) })
+	t.Run("GetCacheVersionsWithFallback", func(t *testing.T) { testGetCacheVersionsWithFallback(t, factory) })
+	t.Run("GetVersionsHistory", func(t *testing.T) { testGetVersionsHistory(t, factory) })
+	t.Run("GetCollectionsFilterActions", func(t *testing.T) { testGetCollectionsFilterActions(t, factory) })
+	t.Run("SessionRoundTrip", func(t *testing.T) { testSessionRoundTrip(t, factory) })
+}
+
+var suiteNow = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func suiteCollections() []cacheStorage.CacheVersions {
+	return []cacheStorage.CacheVersions{
+		{
+			CollectionName:  "menu",
+			CacheType:       "catalog",
+			LockVersionUpon: []string{"checkout"},
+			Versions: []cacheStorage.Version{
+				{Version: "menu-1", TimedTo: suiteNow.Add(-2 * time.Hour)},
+				{Version: "menu-3", TimedTo: suiteNow.Add(time.Hour)},
+				{Version: "menu-2", TimedTo: suiteNow.Add(-time.Hour)},
+			},
+		},
+		{
+			CollectionName:  "prices",
+			CacheType:       "catalog",
+			LockVersionUpon: []string{"checkout", "browse"},
+			Versions: []cacheStorage.Version{
+				{Version: "prices-1", TimedTo: suiteNow.Add(-time.Minute)},
+			},
+		},
+		{
+			CollectionName: "texts",
+			CacheType:      "content",
+			Versions: []cacheStorage.Version{
+				{Version: "texts-2", TimedTo: suiteNow.Add(-time.Hour)},
+				{Version: "texts-1", TimedTo: suiteNow.Add(-48 * time.Hour)},
+			},
+		},
+	}
+}
+
+type suiteRecord struct {
+	Revision int64
+	Value    string
+	Note     string
+}
+
+func testNotFound(t *testing.T, factory RepoFactory) {
+	repo := factory(t, nil)
+	var dest suiteRecord
+	found, err := repo.GetUserSessionByTokenToStruct(context.Background(), "missing", &dest)
+	if err != nil {
+		t.Fatalf("get of a missing session returned error %v", err)
+	}
+	if found {
+		t.Fatalf("get of a missing session reported found")
+	}
+}
+
+func testInsertOrUpdate(t *testing.T, factory RepoFactory) {
+	c := context.Background()
+	repo := factory(t, nil)
+	if err := repo.InsertOrUpdate(c, "s1", suiteRecord{Value: "first"}); err != nil {
+		t.Fatalf("insert failed: %v", err)
+	}
+	if err := repo.InsertOrUpdate(c, "s1", suiteRecord{Value: "second"}); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	assertRecord(t, repo, "s1", suiteRecord{Value: "second"})
+}
+
+func testDelete(t *testing.T, factory RepoFactory) {
+	c := context.Background()
+	repo := factory(t, nil)
+	if err := repo.InsertOrUpdate(c, "s1", suiteRecord{Value: "first"}); err != nil {
+		t.Fatalf("insert failed: %v", err)
+	}
+	if err := repo.Delete(c, "s1"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	var dest suiteRecord
+	if found, err := repo.GetUserSessionByTokenToStruct(c, "s1", &dest); err != nil || found {
+		t.Fatalf("deleted session is still readable, found %v error %v", found, err)
+	}
+	if err := repo.Delete(c, "s1"); err != nil {
+		t.Fatalf("delete of a missing session returned error %v", err)
+	}
+}
+
+func testCompareAndSwap(t *testing.T, factory RepoFactory) {
+	c := context.Background()
+	repo := factory(t, nil)
+	assertSwap(t, repo, "s1", 1, suiteRecord{Revision: 2}, false)
+	assertSwap(t, repo, "s1", 0, suiteRecord{Revision: 1, Value: "first"}, true)
+	assertSwap(t, repo, "s1", 0, suiteRecord{Revision: 1, Value: "stale"}, false)
+	assertSwap(t, repo, "s1", 1, suiteRecord{Revision: 2, Value: "second"}, true)
+	assertRecord(t, repo, "s1", suiteRecord{Revision: 2, Value: "second"})
+
+	if err := repo.Delete(c, "s1"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	assertSwap(t, repo, "s1", 2, suiteRecord{Revision: 3}, false)
+}
+
+func testPatch(t *testing.T, factory RepoFactory) {
+	c := context.Background()
+	repo := factory(t, nil)
+	if found, _, err := repo.Patch(c, "s1", map[string]interface{}{"Value": "patched"}); err != nil || found {
+		t.Fatalf("patch of a missing session returned found %v error %v", found, err)
+	}
+	assertSwap(t, repo, "s1", 0, suiteRecord{Revision: 1, Value: "first", Note: "kept"}, true)
+	found, revision, err := repo.Patch(c, "s1", map[string]interface{}{"Value": "patched"})
+	if err != nil || !found {
+		t.Fatalf("patch failed, found %v error %v", found, err)
+	}
+	if revision != 2 {
+		t.Fatalf("patch returned revision %v, expected 2", revision)
+	}
+	assertRecord(t, repo, "s1", suiteRecord{Revision: 2, Value: "patched", Note: "kept"})
+	assertSwap(t, repo, "s1", 1, suiteRecord{Revision: 2, Value: "stale"}, false)
+}
+
+func testTouch(t *testing.T, factory RepoFactory) {
+	c := context.Background()
+	repo := factory(t, nil)
+	if found, err := repo.Touch(c, "s1", map[string]interface{}{"Note": "touched"}); err != nil || found {
+		t.Fatalf("touch of a missing session returned found %v error %v", found, err)
+	}
+	assertSwap(t, repo, "s1", 0, suiteRecord{Revision: 1, Value: "first", Note: "kept"}, true)
+	found, err := repo.Touch(c, "s1", map[string]interface{}{"Note": "touched"})
+	if err != nil || !found {
+		t.Fatalf("touch failed, found %v error %v", found, err)
+	}
+	assertRecord(t, repo, "s1", suiteRecord{Revision: 1, Value: "first", Note: "touched"})
+	assertSwap(t, repo, "s1", 1, suiteRecord{Revision: 2, Value: "second", Note: "touched"}, true)
+}
+
+func testConcurrentCompareAndSwap(t *testing.T, factory RepoFactory) {
+	c := context.Background()
+	repo := factory(t, nil)
+	if err := repo.InsertOrUpdate(c, "s1", suiteRecord{Revision: 1}); err != nil {
+		t.Fatalf("insert failed: %v", err)
+	}
+
+	const writers = 20
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	swaps := 0
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			swapped, err := repo.CompareAndSwap(c, "s1", 1, suiteRecord{Revision: 2, Value: fmt.Sprint(i)})
+			if err != nil {
+				t.Errorf("compare and swap failed: %v", err)
+				return
+			}
+			if swapped {
+				mu.Lock()
+				swaps++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if swaps != 1 {
+		t.Fatalf("%v concurrent swaps from the same revision succeeded, expected exactly 1", swaps)
+	}
+}
+
+func testConcurrentInsertOrUpdate(t *testing.T, factory RepoFactory) {
+	c := context.Background()
+	repo := factory(t, nil)
+
+	const writers = 20
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("s%v", i)
+			if err := repo.InsertOrUpdate(c, id, suiteRecord{Value: id}); err != nil {
+				t.Errorf("insert failed: %v", err)
+			}
+			var dest suiteRecord
+			if _, err := repo.GetUserSessionByTokenToStruct(c, id, &dest); err != nil {
+				t.Errorf("get failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < writers; i++ {
+		id := fmt.Sprintf("s%v", i)
+		assertRecord(t, repo, id, suiteRecord{Value: id})
+	}
+}
+
+func testGetCacheVersions(t *testing.T, factory RepoFactory) {
+	c := context.Background()
+	repo := factory(t, suiteCollections())
+	tests := []struct {
+		name         string
+		filterAction string
+		filterType   string
+		expected     map[string]string
+	}{
+		{name: "NoFilter", expected: map[string]string{"menu": "menu-2", "prices": "prices-1", "texts": "texts-2"}},
+		{name: "FilterAction", filterAction: "browse", expected: map[string]string{"prices": "prices-1"}},
+		{name: "FilterType", filterType: "content", expected: map[string]string{"texts": "texts-2"}},
+		{name: "FilterActionAndType", filterAction: "checkout", filterType: "catalog", expected: map[string]string{"menu": "menu-2", "prices": "prices-1"}},
+		{name: "NoMatch", filterAction: "unknown", expected: map[string]string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			versions, err := repo.GetCacheVersions(c, suiteNow, test.filterAction, test.filterType)
+			if err != nil {
+				t.Fatalf("get cache versions failed: %v", err)
+			}
+			assertVersions(t, versions, test.expected)
+		})
+	}
+
+	versions, err := repo.GetCacheVersions(c, suiteNow.Add(2*time.Hour), "", "")
+	if err != nil {
+		t.Fatalf("get cache versions failed: %v", err)
+	}
+	assertVersions(t, versions, map[string]string{"menu": "menu-3", "prices": "prices-1", "texts": "texts-2"})
+}
+
+func testGetCacheVersionsNoVersion(t *testing.T, factory RepoFactory) {
+	repo := factory(t, suiteCollections())
+	if _, err := repo.GetCacheVersions(context.Background(), suiteNow.Add(-30*time.Minute), "", ""); err == nil {
+		t.Fatalf("expected an error when a collection has no version before now")
+	}
+}
+
+func testGetCacheVersionsWithFallback(t *testing.T, factory RepoFactory) {
+	c := context.Background()
+	repo := factory(t, suiteCollections())
+	tests := []struct {
+		now      time.Time
+		fallback models.VersionFallbackPolicy
+		expected map[string]string
+		fellBack []string
+	}{
+		{suiteNow, models.VersionFallbackPolicy{}, map[string]string{"menu": "menu-2", "prices": "prices-1", "texts": "texts-2"}, nil},
+		{suiteNow.Add(-30 * time.Minute), models.VersionFallbackPolicy{Collections: map[string]models.VersionFallback{"prices": models.UseOldestVersion}},
+			map[string]string{"menu": "menu-2", "prices": "prices-1", "texts": "texts-2"}, []string{"prices"}},
+		{suiteNow.Add(-30 * time.Minute), models.VersionFallbackPolicy{Default: models.SkipCollection},
+			map[string]string{"menu": "menu-2", "texts": "texts-2"}, []string{"prices"}},
+		{suiteNow.Add(-72 * time.Hour), models.VersionFallbackPolicy{Default: models.UseOldestVersion},
+			map[string]string{"menu": "menu-1", "prices": "prices-1", "texts": "texts-1"}, []string{"menu", "prices", "texts"}},
+	}
+	for _, test := range tests {
+		versions, fellBack, err := repo.GetCacheVersionsWithFallback(c, test.now, "", "", test.fallback)
+		if err != nil {
+			t.Fatalf("get versions of %v failed: %v", test.now, err)
+		}
+		assertVersions(t, versions, test.expected)
+		sort.Strings(fellBack)
+		if len(fellBack) != len(test.fellBack) || (len(fellBack) > 0 && !reflect.DeepEqual(fellBack, test.fellBack)) {
+			t.Fatalf("collections %v fell back by %v, expected %v", fellBack, test.now, test.fellBack)
+		}
+	}
+	_, _, err := repo.GetCacheVersionsWithFallback(c, suiteNow.Add(-30*time.Minute), "", "", models.VersionFallbackPolicy{Default: models.UseOldestVersion, Collections: map[string]models.VersionFallback{"prices": models.FailWithoutVersion}})
+	if err == nil {
+		t.Fatalf("expected an error when a collection without a version must fail")
+	}
+}
+
+func testGetVersionsHistory(t *testing.T, factory RepoFactory) {
+	repo := factory(t, append(suiteCollections(), cacheStorage.CacheVersions{
+		CollectionName: "banners",
+		CacheType:      "content",
+		Versions: []cacheStorage.Version{
+			{Version: "banners-2", TimedTo: suiteNow.Add(-time.Hour)},
+			{Version: "banners-1a", TimedTo: suiteNow.Add(-2 * time.Hour)},
+			{Version: "banners-1b", TimedTo: suiteNow.Add(-2 * time.Hour)},
+		},
+	}))
+	history, err := repo.GetVersionsHistory(context.Background())
+	if err != nil {
+		t.Fatalf("get versions history failed: %v", err)
+	}
+	expected := []models.TimedVersion{
+		{Version: "menu-1", TimedTo: suiteNow.Add(-2 * time.Hour)},
+		{Version: "menu-2", TimedTo: suiteNow.Add(-time.Hour)},
+		{Version: "menu-3", TimedTo: suiteNow.Add(time.Hour)},
+	}
+	if len(history) != 4 || !reflect.DeepEqual(history["menu"], expected) {
+		t.Fatalf("menu history is %v, expected %v", history["menu"], expected)
+	}
+	expected = []models.TimedVersion{
+		{Version: "banners-1a", TimedTo: suiteNow.Add(-2 * time.Hour)},
+		{Version: "banners-2", TimedTo: suiteNow.Add(-time.Hour)},
+	}
+	if !reflect.DeepEqual(history["banners"], expected) {
+		t.Fatalf("versions timed to the same moment were not merged, banners history is %v, expected %v", history["banners"], expected)
+	}
+}
+
+func testGetCollectionsFilterActions(t *testing.T, factory RepoFactory) {
+	c := context.Background()
+	repo := factory(t, suiteCollections())
+	tests := map[string][]string{
+		"":         {"menu", "prices", "texts"},
+		"checkout": {"menu", "prices"},
+		"browse":   {"prices"},
+		"unknown":  {},
+	}
+	for action, expected := range tests {
+		collections, err := repo.GetCollectionsFilterActions(c, action)
+		if err != nil {
+			t.Fatalf("get collections for action %q failed: %v", action, err)
+		}
+		sort.Strings(collections)
+		if fmt.Sprint(collections) != fmt.Sprint(expected) {
+			t.Errorf("collections for action %q are %v, expected %v", action, collections, expected)
+		}
+	}
+}
+
+func testSessionRoundTrip(t *testing.T, factory RepoFactory) {
+	c := context.Background()
+	resolver, err := sessionresolver.Builder().SetRepo(factory(t, suiteCollections())).
+		SetMaxLifetime(time.Hour).SetClock(NewFakeClock(suiteNow)).Build()
+	if err != nil {
+		t.Fatalf("build resolver failed: %v", err)
+	}
+
+	saved := resolver.NewSession("s1")
+	saved.SetCustomerDetails("customer", true)
+	saved.SetOtpData("otp")
+	saved.SetFakeClock(-time.Hour, 2)
+	saved.SetFixedCacheVersions(map[string]string{"menu": "menu-1"})
+	saved.SetCurrentCacheVersions(map[string]string{"prices": "prices-1"})
+	saved.SetVersionPreview(suiteNow.Add(24*time.Hour), map[string]string{"texts": "texts-3"})
+	saved.SetFreezeScope("checkout", map[string]string{"prices": "prices-2", "texts": "texts-1"}, suiteNow.Add(time.Hour))
+	saved.SetLang("he")
+	if err := saved.SetTimeZone("Asia/Jerusalem"); err != nil {
+		t.Fatalf("set time zone failed: %v", err)
+	}
+	saved.SetTermsApproval(true)
+	saved.SetDeviceInfo("hardware", "runtime", "os", "model", "browser", "1.0.0", "14")
+	saved.SetReferrer("referrer")
+	saved.SetActiveOrder("order", "delivery", "store", suiteNow.Add(time.Hour), []string{"tag"})
+	saved.SetActiveOrderVersions(map[string]string{"menu": "menu-2"})
+	saved.SetOrder("pickup", "draft", "pickup", "other-store", suiteNow.Add(2*time.Hour), nil)
+	if written, err := resolver.SaveSession(c, saved); err != nil || !written {
+		t.Fatalf("save failed, written %v error %v", written, err)
+	}
+
+	found, loaded, err := resolver.GetSessionById(c, "s1")
+	if err != nil || !found {
+		t.Fatalf("saved session not loaded, found %v error %v", found, err)
+	}
+	savedJson, err := json.Marshal(saved)
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	loadedJson, err := json.Marshal(loaded)
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	if string(savedJson) != string(loadedJson) {
+		t.Fatalf("session changed on the way through the repo\nsaved:  %s\nloaded: %s", savedJson, loadedJson)
+	}
+	if !loaded.GetNow().Equal(suiteNow.Add(-time.Hour)) || !loaded.GetExpiresAt().Equal(suiteNow.Add(time.Hour)) || loaded.GetLocalNow().Location().String() != "Asia/Jerusalem" || loaded.GetDeviceInfo().GetOSVersion() != "14" || loaded.GetRevision() != 1 ||
+		loaded.GetActiveOrder().GetVersions()["menu"] != "menu-2" || len(loaded.GetOrders()) != 2 ||
+		loaded.GetEffectiveCacheVersions()["prices"] != "prices-2" || len(loaded.GetFreezeScopes()) != 1 ||
+		!loaded.GetVersionPreviewAsOf().Equal(suiteNow.Add(24*time.Hour)) {
+		t.Fatalf("loaded session does not resolve like the saved one")
+	}
+
+	versions := loaded.GetCurrentCacheVersions()
+	versions["prices"] = "prices-3"
+	loaded.SetCurrentCacheVersions(versions)
+	if written, err := resolver.SaveSession(c, loaded); err != nil || !written {
+		t.Fatalf("save of changed versions failed, written %v error %v", written, err)
+	}
+	if _, reloaded, err := resolver.GetSessionById(c, "s1"); err != nil || reloaded.GetCurrentCacheVersions()["prices"] != "prices-3" {
+		t.Fatalf("changed versions were not saved, error %v", err)
+	}
+}
+
+func assertSwap(t *testing.T, repo session.SessionRepo, id string, revision int64, obj suiteRecord, expected bool) {
+	t.Helper()
+	swapped, err := repo.CompareAndSwap(context.Background(), id, revision, obj)
+	if err != nil {
+		t.Fatalf("compare and swap failed: %v", err)
+	}
+	if swapped != expected {
+		t.Fatalf("compare and swap of %v over revision %v returned %v, expected %v", id, revision, swapped, expected)
+	}
+}
+
+func assertRecord(t *testing.T, repo session.SessionRepo, id string, expected suiteRecord) {
+	t.Helper()
+	var dest suiteRecord
+	found, err := repo.GetUserSessionByTokenToStruct(context.Background(), id, &dest)
+	if err != nil || !found {
+		t.Fatalf("session %v not found, error %v", id, err)
+	}
+	if dest != expected {
+		t.Fatalf("session %v is %+v, expected %+v", id, dest, expected)
+	}
+}
+
+func assertVersions(t *testing.T, versions, expected map[string]string) {
+	t.Helper()
+	if len(versions) != len(expected) {
+		t.Fatalf("versions are %v, expected %v", versions, expected)
+	}
+	for collection, version := range expected {
+		if versions[collection] != version {
+			t.Fatalf("versions are %v, expected %v", versions, expected)
+		}
+	}
+}